@@ -0,0 +1,22 @@
+#!/bin/bash
+# Usage: ./create_keys.sh [key_file]
+# Example: ./create_keys.sh keys.json
+# Writes the key file the producer and consumer encrypt payload
+# fields with, docker-compose mounts ./keys.json. Layout:
+#   {"active_key_id": "<id>", "keys": {"<id>": "<base64 of 32 random bytes>"}}
+# To rotate add a new key to "keys" and point active_key_id at it,
+# keep the old one until no message encrypted with it is left
+
+KEY_FILE="${1:-$(dirname "$0")/keys.json}"
+
+if [ -e "$KEY_FILE" ]; then
+  echo "$KEY_FILE already exists, not overwriting it"
+  exit 1
+fi
+
+KEY_ID="key-$(date +"%Y%m%d")"
+KEY=$(head -c 32 /dev/urandom | base64)
+
+umask 077
+printf '{"active_key_id": "%s", "keys": {"%s": "%s"}}\n' "$KEY_ID" "$KEY_ID" "$KEY" > "$KEY_FILE"
+echo "Created key file: $KEY_FILE"
@@ -1,6 +1,7 @@
 #!/bin/bash
 # Usage: ./create_migration.sh migration_name
 # Example: ./create_migration.sh add_users_table
+# Same as: go run main.go migrate create add_users_table
 
 if [ -z "$1" ]; then
   echo "Usage: $0 migration_name"
@@ -12,5 +13,5 @@ DATE=$(date +"%Y%m%d%H%M%S")
 FILENAME="${DATE}_$1.sql"
 
 mkdir -p "$MIGRATIONS_DIR"
-touch "$MIGRATIONS_DIR/$FILENAME"
+printf -- "-- +migrate up\n\n\n-- +migrate down\n\n" > "$MIGRATIONS_DIR/$FILENAME"
 echo "Created migration: $MIGRATIONS_DIR/$FILENAME"
\ No newline at end of file
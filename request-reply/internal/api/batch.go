@@ -0,0 +1,80 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/serdarozerr/request-reply/internal/service/batch"
+	"github.com/serdarozerr/request-reply/internal/service/encryption"
+	m "github.com/serdarozerr/request-reply/pkg/middleware"
+)
+
+// submitBatch fans the items out into one child job each
+func submitBatch(db *pg.DB, kp encryption.KeyProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		var req batch.Request
+		body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		b, err := batch.Submit(r.Context(), db, kp, &req, m.UserFromContext(r.Context()))
+		if errors.Is(err, batch.ErrInvalidBatch) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			slog.Error("submitting batch", "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("batch submitted", "batch_id", b.BatchID, "type", req.Type, "total", b.Total)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]any{
+			"batch_id": b.BatchID,
+			"total":    b.Total,
+		})
+	}
+}
+
+// getBatch reports the progress of a batch
+func getBatch(db *pg.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		batchID := r.PathValue("id")
+
+		b, err := batch.Get(r.Context(), db, batchID)
+		if errors.Is(err, pg.ErrNoRows) {
+			http.Error(w, "batch not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("getting batch", "batch_id", batchID, "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(batchProgress(b))
+	}
+}
+
+func batchProgress(b *batch.Batch) map[string]any {
+	return map[string]any{
+		"batch_id":     b.BatchID,
+		"total":        b.Total,
+		"done":         b.Done(),
+		"succeeded":    b.Succeeded,
+		"failed":       b.Failed,
+		"cancelled":    b.Cancelled,
+		"sealed":       b.Sealed,
+		"completed_at": b.CompletedAt,
+	}
+}
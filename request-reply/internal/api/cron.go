@@ -0,0 +1,144 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/serdarozerr/request-reply/internal/service/scheduler"
+)
+
+type cronJobRequest struct {
+	Type     string         `json:"type"`
+	Schedule string         `json:"schedule"`
+	Timezone string         `json:"timezone"`
+	Payload  map[string]any `json:"payload"`
+	Paused   bool           `json:"paused"`
+}
+
+func listCronJobs(db *pg.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cronJobs, err := scheduler.ListCronJobs(r.Context(), db)
+		if err != nil {
+			slog.Error("listing cron jobs", "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if cronJobs == nil {
+			cronJobs = []*scheduler.CronJob{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"cron_jobs": cronJobs})
+	}
+}
+
+func getCronJob(db *pg.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := scheduler.GetCronJob(r.Context(), db, r.PathValue("name"))
+		if err != nil {
+			writeCronError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+// putCronJob creates or replaces the cron job named in the path
+func putCronJob(db *pg.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		var req cronJobRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		c := &scheduler.CronJob{
+			Name:     r.PathValue("name"),
+			Type:     req.Type,
+			Schedule: req.Schedule,
+			Timezone: req.Timezone,
+			Payload:  req.Payload,
+			Paused:   req.Paused,
+		}
+		if err := scheduler.SaveCronJob(r.Context(), db, c); err != nil {
+			writeCronError(w, r, err)
+			return
+		}
+
+		slog.Info("cron job saved", "cron", c.Name, "schedule", c.Schedule, "timezone", c.Timezone)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+func deleteCronJob(db *pg.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+
+		deleted, err := scheduler.DeleteCronJob(r.Context(), db, name)
+		if err != nil {
+			writeCronError(w, r, err)
+			return
+		}
+		if !deleted {
+			http.Error(w, "cron job not found", http.StatusNotFound)
+			return
+		}
+
+		slog.Info("cron job deleted", "cron", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// triggerCronJob runs the cron job now, it is rejected while
+// the previous run is still active
+func triggerCronJob(db *pg.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+
+		jobID, err := scheduler.TriggerCronJob(r.Context(), db, name)
+		if err != nil {
+			writeCronError(w, r, err)
+			return
+		}
+
+		slog.Info("cron job triggered", "cron", name, "job_id", jobID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]any{"job_id": jobID})
+	}
+}
+
+func pauseCronJob(db *pg.DB, paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := scheduler.SetCronJobPaused(r.Context(), db, r.PathValue("name"), paused)
+		if err != nil {
+			writeCronError(w, r, err)
+			return
+		}
+
+		slog.Info("cron job updated", "cron", c.Name, "paused", c.Paused)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+func writeCronError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, pg.ErrNoRows):
+		http.Error(w, "cron job not found", http.StatusNotFound)
+	case errors.Is(err, scheduler.ErrInvalidCronJob):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, scheduler.ErrCronJobRunning):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		slog.Error("handling cron job", "path", r.URL.Path, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+}
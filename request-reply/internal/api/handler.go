@@ -1,25 +1,80 @@
 package api
 
 import (
+	"log/slog"
 	"net/http"
 
-	"github.com/serdarozerr/request-reply/internal/service/queue"
+	"github.com/go-pg/pg/v10"
+	"github.com/serdarozerr/request-reply/internal/config"
+	"github.com/serdarozerr/request-reply/internal/service/encryption"
+	"github.com/serdarozerr/request-reply/internal/service/idempotency"
+	"github.com/serdarozerr/request-reply/internal/service/jobs"
+	"github.com/serdarozerr/request-reply/internal/service/quarantine"
 	m "github.com/serdarozerr/request-reply/pkg/middleware"
 )
 
-// var (
-// 	authMiddleware = m.AuthMiddleware(config.NewConfig())
-// )
+func addUserRoutes(mux *http.ServeMux, cfg *config.Config, db *pg.DB, kp encryption.KeyProvider) {
+	idempotent := m.Idempotency(idempotency.NewPostgresStore(db), cfg.IdempotencyLockTTL(), cfg.IdempotencyTTL())
 
-func addUserRoutes(mux *http.ServeMux, producer *queue.Producer) {
-	mux.HandleFunc("/api/v1/users", m.HttpLogger(users(producer)))
+	mux.HandleFunc("/api/v1/users", m.HttpLogger(idempotent(users(db, kp))))
+	mux.HandleFunc("POST /api/v1/users/import", m.HttpLogger(userImport(db, kp)))
+	mux.HandleFunc("GET /api/v1/users/import/{id}", m.HttpLogger(userImportStatus(db)))
 }
 
 
 
-func NewRouter(producer *queue.Producer) http.Handler {
+func addJobRoutes(mux *http.ServeMux, db *pg.DB, results *jobs.ResultStore) {
+	mux.HandleFunc("GET /api/v1/jobs", m.HttpLogger(listJobs(db)))
+	mux.HandleFunc("GET /api/v1/jobs/stats", m.HttpLogger(jobStats(db)))
+	mux.HandleFunc("GET /api/v1/jobs/{id}", m.HttpLogger(job(db)))
+	mux.HandleFunc("DELETE /api/v1/jobs/{id}", m.HttpLogger(cancelJob(db)))
+	mux.HandleFunc("GET /api/v1/jobs/{id}/result", m.HttpLogger(jobResult(db, results)))
+}
+
+func addWorkflowRoutes(mux *http.ServeMux, db *pg.DB, kp encryption.KeyProvider) {
+	mux.HandleFunc("POST /api/v1/workflows", m.HttpLogger(submitWorkflow(db, kp)))
+	mux.HandleFunc("GET /api/v1/sagas/stuck", m.HttpLogger(stuckSagas(db)))
+}
+
+func addBatchRoutes(mux *http.ServeMux, db *pg.DB, kp encryption.KeyProvider) {
+	mux.HandleFunc("POST /api/v1/batches", m.HttpLogger(submitBatch(db, kp)))
+	mux.HandleFunc("GET /api/v1/batches/{id}", m.HttpLogger(getBatch(db)))
+}
+
+func addCronRoutes(mux *http.ServeMux, db *pg.DB) {
+	mux.HandleFunc("GET /api/v1/cron", m.HttpLogger(listCronJobs(db)))
+	mux.HandleFunc("GET /api/v1/cron/{name}", m.HttpLogger(getCronJob(db)))
+	mux.HandleFunc("PUT /api/v1/cron/{name}", m.HttpLogger(putCronJob(db)))
+	mux.HandleFunc("DELETE /api/v1/cron/{name}", m.HttpLogger(deleteCronJob(db)))
+	mux.HandleFunc("POST /api/v1/cron/{name}/trigger", m.HttpLogger(triggerCronJob(db)))
+	mux.HandleFunc("POST /api/v1/cron/{name}/pause", m.HttpLogger(pauseCronJob(db, true)))
+	mux.HandleFunc("POST /api/v1/cron/{name}/resume", m.HttpLogger(pauseCronJob(db, false)))
+}
+
+func addQuarantineRoutes(mux *http.ServeMux, db *pg.DB) {
+	store := quarantine.NewPostgresStore(db)
+	mux.HandleFunc("GET /api/v1/quarantine", m.HttpLogger(listQuarantined(store)))
+	mux.HandleFunc("GET /api/v1/quarantine/{id}", m.HttpLogger(getQuarantined(store)))
+	mux.HandleFunc("DELETE /api/v1/quarantine/{id}", m.HttpLogger(deleteQuarantined(store)))
+}
+
+func NewRouter(cfg *config.Config, db *pg.DB, kp encryption.KeyProvider, results *jobs.ResultStore) http.Handler {
 	mux := http.NewServeMux()
-	addUserRoutes(mux,producer)
+	addUserRoutes(mux,cfg,db,kp)
+	addJobRoutes(mux,db,results)
+	addCronRoutes(mux,db)
+	addWorkflowRoutes(mux,db,kp)
+	addBatchRoutes(mux,db,kp)
+	addQuarantineRoutes(mux,db)
 
-	return mux
+	if cfg.Auth.JWTSecretFile == "" {
+		slog.Warn("auth is disabled, jobs are recorded without a submitter")
+		return mux
+	}
+	verifier, err := m.NewJWTVerifier(cfg.Auth)
+	if err != nil {
+		slog.Error("Failed to configure auth", "error", err)
+		panic(1)
+	}
+	return m.AuthMiddleware(verifier)(mux)
 }
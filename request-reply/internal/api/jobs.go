@@ -0,0 +1,340 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/serdarozerr/request-reply/internal/models"
+	"github.com/serdarozerr/request-reply/internal/service/jobs"
+	"github.com/serdarozerr/request-reply/internal/service/workflow"
+	m "github.com/serdarozerr/request-reply/pkg/middleware"
+)
+
+// job returns the job with its attempt history, and
+// the state of every step when the job is a workflow
+func job(db *pg.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jobID := r.PathValue("id")
+
+		j, err := models.GetJob(db.WithContext(r.Context()), jobID)
+		if errors.Is(err, pg.ErrNoRows) {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("getting job", "job_id", jobID, "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		attempts, err := models.ListJobAttempts(db.WithContext(r.Context()), jobID)
+		if err != nil {
+			slog.Error("listing job attempts", "job_id", jobID, "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if attempts == nil {
+			attempts = []*models.JobAttempt{}
+		}
+
+		res := map[string]any{
+			"job":      j,
+			"attempts": attempts,
+		}
+
+		if j.Type == workflow.JobType {
+			wf, err := workflow.Get(r.Context(), db, jobID)
+			if err != nil && !errors.Is(err, pg.ErrNoRows) {
+				slog.Error("getting workflow", "job_id", jobID, "error", err)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+			if wf != nil {
+				res["workflow"] = wf
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// submittedBy reports whether the caller submitted the job, other
+// callers get a 404 so they can't tell the job exists
+func submittedBy(r *http.Request, j *models.Job) bool {
+	return j.Submitter == m.UserFromContext(r.Context())
+}
+
+// cancelJob cancels the job together with its unfinished child
+// jobs, e.g. every row of an import
+func cancelJob(db *pg.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jobID := r.PathValue("id")
+
+		j, err := models.GetJob(db.WithContext(r.Context()), jobID)
+		if errors.Is(err, pg.ErrNoRows) || err == nil && !submittedBy(r, j) {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("getting job", "job_id", jobID, "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		j, children, err := jobs.Cancel(r.Context(), db, jobID)
+		switch {
+		case errors.Is(err, pg.ErrNoRows):
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		case errors.Is(err, models.ErrInvalidTransition):
+			http.Error(w, "job is already finished", http.StatusConflict)
+			return
+		case err != nil:
+			slog.Error("cancelling job", "job_id", jobID, "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("job cancelled", "job_id", jobID, "cancelled_children", children)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"job":                j,
+			"cancelled_children": children,
+		})
+	}
+}
+
+// jobResult returns the output of a succeeded job with the
+// content type the handler gave it
+func jobResult(db *pg.DB, results *jobs.ResultStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jobID := r.PathValue("id")
+
+		j, err := models.GetJob(db.WithContext(r.Context()), jobID)
+		if errors.Is(err, pg.ErrNoRows) || err == nil && !submittedBy(r, j) {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("getting job", "job_id", jobID, "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if j.Status != models.JobStatusSucceeded {
+			http.Error(w, fmt.Sprintf("job is %s, results are only available for succeeded jobs", j.Status), http.StatusConflict)
+			return
+		}
+
+		res, data, err := results.Get(r.Context(), jobID)
+		switch {
+		case errors.Is(err, jobs.ErrNoResult):
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case errors.Is(err, jobs.ErrResultExpired):
+			http.Error(w, "job result has expired", http.StatusGone)
+			return
+		case err != nil:
+			slog.Error("getting job result", "job_id", jobID, "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", res.ContentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Expires", res.ExpiresAt.UTC().Format(http.TimeFormat))
+		w.Write(data)
+	}
+}
+
+const (
+	defaultJobPageSize = 50
+	maxJobPageSize     = 500
+)
+
+// listJobs returns a page of jobs, filtered by type, status,
+// submitter, parent_id and a from/to range on created_at. Pages
+// are ordered by created_at, sort=-created_at for newest first,
+// next_cursor is passed back as cursor to get the next page
+func listJobs(db *pg.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		filter, err := parseJobFilter(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts := models.JobListOptions{JobFilter: filter, Limit: defaultJobPageSize}
+
+		switch q.Get("sort") {
+		case "", "created_at":
+		case "-created_at":
+			opts.Desc = true
+		default:
+			http.Error(w, "sort must be created_at or -created_at", http.StatusBadRequest)
+			return
+		}
+
+		if l := q.Get("limit"); l != "" {
+			opts.Limit, err = strconv.Atoi(l)
+			if err != nil || opts.Limit <= 0 || opts.Limit > maxJobPageSize {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxJobPageSize), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if c := q.Get("cursor"); c != "" {
+			opts.After, err = decodeJobCursor(c)
+			if err != nil {
+				http.Error(w, "invalid cursor", http.StatusBadRequest)
+				return
+			}
+		}
+
+		jobs, next, err := models.ListJobs(db.WithContext(r.Context()), opts)
+		if err != nil {
+			slog.Error("listing jobs", "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if jobs == nil {
+			jobs = []*models.Job{}
+		}
+
+		res := map[string]any{"jobs": jobs}
+		if next != nil {
+			res["next_cursor"] = encodeJobCursor(next)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// jobStats returns the number of jobs per status and type,
+// it takes the same filters as listJobs
+func jobStats(db *pg.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseJobFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		counts, err := models.CountJobs(db.WithContext(r.Context()), filter)
+		if err != nil {
+			slog.Error("counting jobs", "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		total := 0
+		byStatus := make(map[string]int)
+		byType := make(map[string]map[string]int)
+		for _, c := range counts {
+			total += c.Count
+			byStatus[c.Status] += c.Count
+			if byType[c.Type] == nil {
+				byType[c.Type] = make(map[string]int)
+			}
+			byType[c.Type][c.Status] = c.Count
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"total":     total,
+			"by_status": byStatus,
+			"by_type":   byType,
+		})
+	}
+}
+
+func parseJobFilter(q url.Values) (models.JobFilter, error) {
+	f := models.JobFilter{
+		Types:     splitList(q["type"]),
+		Statuses:  splitList(q["status"]),
+		Submitter: q.Get("submitter"),
+		ParentID:  q.Get("parent_id"),
+	}
+
+	for _, s := range f.Statuses {
+		if _, ok := jobStatuses[s]; !ok {
+			return f, fmt.Errorf("unknown status %q", s)
+		}
+	}
+
+	var err error
+	if from := q.Get("from"); from != "" {
+		if f.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return f, fmt.Errorf("from must be an RFC 3339 time")
+		}
+	}
+	if to := q.Get("to"); to != "" {
+		if f.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return f, fmt.Errorf("to must be an RFC 3339 time")
+		}
+	}
+	return f, nil
+}
+
+var jobStatuses = map[string]struct{}{
+	models.JobStatusScheduled: {},
+	models.JobStatusQueued:    {},
+	models.JobStatusReceived:  {},
+	models.JobStatusRunning:   {},
+	models.JobStatusRetrying:  {},
+	models.JobStatusSucceeded: {},
+	models.JobStatusFailed:    {},
+	models.JobStatusDead:      {},
+	models.JobStatusCancelled: {},
+}
+
+// splitList accepts both repeated parameters and comma separated values
+func splitList(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
+
+// the cursor is opaque to clients, it holds the created_at
+// and id of the last job of the previous page
+func encodeJobCursor(c *models.JobCursor) string {
+	raw := strconv.FormatInt(c.CreatedAt.UnixMicro(), 10) + ":" + strconv.FormatInt(c.ID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeJobCursor(s string) (*models.JobCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	ts, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return nil, errors.New("malformed cursor")
+	}
+	micros, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	c := &models.JobCursor{CreatedAt: time.UnixMicro(micros).UTC()}
+	if c.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/serdarozerr/request-reply/internal/service/quarantine"
+)
+
+const (
+	defaultQuarantineLimit = 50
+	maxQuarantineLimit     = 500
+)
+
+// listQuarantined pages through quarantined messages newest
+// first, pass the last id of a page as before to get the next
+func listQuarantined(store quarantine.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		limit := defaultQuarantineLimit
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > maxQuarantineLimit {
+				http.Error(w, "limit must be between 1 and 500", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		var before int64
+		if v := q.Get("before"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				http.Error(w, "invalid before", http.StatusBadRequest)
+				return
+			}
+			before = n
+		}
+
+		messages, err := store.List(r.Context(), before, limit)
+		if err != nil {
+			slog.Error("listing quarantined messages", "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if messages == nil {
+			messages = []*quarantine.Message{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"messages": messages})
+	}
+}
+
+func getQuarantined(store quarantine.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "quarantined message not found", http.StatusNotFound)
+			return
+		}
+
+		msg, err := store.Get(r.Context(), id)
+		if err != nil {
+			writeQuarantineError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(msg)
+	}
+}
+
+// deleteQuarantined discards a message once it has been inspected
+func deleteQuarantined(store quarantine.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "quarantined message not found", http.StatusNotFound)
+			return
+		}
+
+		if err := store.Delete(r.Context(), id); err != nil {
+			writeQuarantineError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeQuarantineError(w http.ResponseWriter, err error) {
+	if errors.Is(err, quarantine.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	slog.Error("quarantine", "error", err)
+	http.Error(w, "internal server error", http.StatusInternalServerError)
+}
@@ -6,12 +6,18 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/go-pg/pg/v10"
 	"github.com/google/uuid"
+	"github.com/serdarozerr/request-reply/internal/models"
+	"github.com/serdarozerr/request-reply/internal/service/encryption"
+	"github.com/serdarozerr/request-reply/internal/service/outbox"
 	"github.com/serdarozerr/request-reply/internal/service/queue"
+	"github.com/serdarozerr/request-reply/internal/service/scheduler"
 	"github.com/serdarozerr/request-reply/internal/validators"
 	v "github.com/serdarozerr/request-reply/pkg"
+	m "github.com/serdarozerr/request-reply/pkg/middleware"
 )
-func users(producer* queue.Producer) http.HandlerFunc{
+func users(db *pg.DB, kp encryption.KeyProvider) http.HandlerFunc{
 	return func (w http.ResponseWriter, r *http.Request) {
 		if r.Body == nil {
 			http.Error(w, "request body is empty", http.StatusBadRequest)
@@ -37,13 +43,40 @@ func users(producer* queue.Producer) http.HandlerFunc{
 		}
 
 		jobID:=uuid.NewString()
-		producer.SendMessage(r.Context(),&queue.Message{
+		msg:=&queue.Message{
 			Version:"1",
 			ID:jobID,
 			Type:"user.create",
 			Payload:map[string]any{"name":data.Name,"email":data.Email, "age":data.Age, "password":data.Password},
-			Timestamp:time.Now()}, 
-			20)
+			Timestamp:time.Now(),
+			ExpiresAt:data.ExpiresAt}
+
+		msg.Encryption, err = encryption.Seal(r.Context(), kp, jobID, msg.Payload, encryption.TaggedFields(data))
+		if err != nil {
+			slog.Error("encrypting payload", "job_id", jobID, "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// the job and its message are committed together,
+		// the outbox relay publishes the message afterwards
+		err = db.RunInTransaction(r.Context(), func(tx *pg.Tx) error {
+			job := models.NewJob(jobID, msg.Type, "")
+			job.Submitter = m.UserFromContext(r.Context())
+			if data.RunAt != nil {
+				return scheduler.Schedule(tx, job, msg, *data.RunAt)
+			}
+			err := models.InsertJob(tx, job)
+			if err != nil {
+				return err
+			}
+			return outbox.Enqueue(tx, msg, 20)
+		})
+		if err != nil {
+			slog.Error("creating job", "job_id", jobID, "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
 
 		slog.Info("send it to queueu", "data", jobID)
 		w.Header().Set("Content-Type", "application/json")
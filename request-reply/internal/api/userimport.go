@@ -0,0 +1,408 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/serdarozerr/request-reply/internal/models"
+	"github.com/serdarozerr/request-reply/internal/service/batch"
+	"github.com/serdarozerr/request-reply/internal/service/encryption"
+	"github.com/serdarozerr/request-reply/internal/service/outbox"
+	"github.com/serdarozerr/request-reply/internal/service/queue"
+	"github.com/serdarozerr/request-reply/internal/validators"
+	m "github.com/serdarozerr/request-reply/pkg/middleware"
+)
+
+const (
+	// upper limit of an uploaded import file
+	maxImportBytes = 64 << 20
+	// valid rows are stored and enqueued in chunks of this size
+	importChunkSize = 1000
+	// large files take longer than the server's read and
+	// write timeouts, the import route gets its own
+	importTimeout = 5 * time.Minute
+)
+
+type rowError struct {
+	Row    int               `json:"row"`
+	Errors map[string]string `json:"errors"`
+}
+
+// importReport is returned even when the upload is cut short, rows
+// up to LastRow are handled and a retry should start after it
+type importReport struct {
+	ImportID string     `json:"import_id"`
+	Total    int        `json:"total"`
+	Accepted int        `json:"accepted"`
+	Rejected int        `json:"rejected"`
+	Errors   []rowError `json:"errors"`
+	Complete bool       `json:"complete"`
+	LastRow  int        `json:"last_row"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// rowReader returns the next row of an upload, io.EOF when done,
+// invalidRowError when only the current row can't be parsed and
+// errBlankRow for a row that is skipped but still numbered
+type rowReader func() (validators.CreateUser, error)
+
+var errBlankRow = errors.New("blank row")
+
+type invalidRowError struct {
+	err error
+}
+
+func (e invalidRowError) Error() string {
+	return e.err.Error()
+}
+
+// userImport accepts a CSV (with a name,email,password,age header)
+// or NDJSON upload and enqueues every valid row as user.create
+func userImport(db *pg.DB, kp encryption.KeyProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(time.Now().Add(importTimeout)); err != nil {
+			slog.Warn("extending import read deadline", "error", err)
+		}
+		if err := rc.SetWriteDeadline(time.Now().Add(importTimeout)); err != nil {
+			slog.Warn("extending import write deadline", "error", err)
+		}
+
+		body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+
+		next, err := newRowReader(r.Header.Get("Content-Type"), body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+
+		// the import is a batch that is sealed once the
+		// whole file is read, its progress is counted there
+		importID := uuid.NewString()
+		err = batch.Create(db, &batch.Batch{BatchID: importID}, "user.import", m.UserFromContext(r.Context()))
+		if err != nil {
+			slog.Error("creating import job", "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		report := importReport{ImportID: importID, Errors: []rowError{}}
+		var chunk []*queue.Message
+
+		// an aborted upload keeps the rows enqueued so far
+		sealed := false
+		defer func() {
+			if sealed {
+				return
+			}
+			if err := batch.Seal(context.Background(), db, importID, report.Accepted); err != nil {
+				slog.Error("sealing aborted import", "import_id", importID, "error", err)
+			}
+		}()
+
+		// rows of the pending chunk are only
+		// handled once the chunk is enqueued
+		chunkStart := 1
+		flush := func(nextRow int) error {
+			if err := enqueueImportChunk(r, db, importID, chunk); err != nil {
+				return err
+			}
+			report.Accepted += len(chunk)
+			report.LastRow = nextRow - 1
+			chunk = chunk[:0]
+			chunkStart = nextRow
+			return nil
+		}
+
+		// rows enqueued before the failure stay enqueued, the
+		// report tells the client where a retry has to resume
+		fail := func(status int, msg string) {
+			if report.Accepted > 0 {
+				status = http.StatusAccepted
+			}
+			report.Error = msg
+			writeImportReport(w, status, report)
+		}
+		abort := func(row, status int, msg string) {
+			if err := flush(row); err != nil {
+				slog.Error("enqueuing import rows", "import_id", importID, "error", err)
+				report.LastRow = chunkStart - 1
+			}
+			fail(status, msg)
+		}
+
+		row := 0
+		for {
+			row++
+			data, err := next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if errors.Is(err, errBlankRow) {
+				continue
+			}
+
+			var (
+				rowErr invalidRowError
+				maxErr *http.MaxBytesError
+			)
+			switch {
+			case errors.As(err, &maxErr):
+				abort(row, http.StatusRequestEntityTooLarge, "import file is too large")
+				return
+			case errors.As(err, &rowErr):
+				report.Total++
+				report.Rejected++
+				report.Errors = append(report.Errors, rowError{Row: row, Errors: map[string]string{"row": rowErr.Error()}})
+				continue
+			case err != nil:
+				slog.Error("reading import file", "import_id", importID, "error", err)
+				abort(row, http.StatusBadRequest, "can't read import file")
+				return
+			}
+
+			report.Total++
+
+			// import rows are enqueued straight away, scheduled
+			// or expiring users are created through /api/v1/users
+			if data.RunAt != nil || data.ExpiresAt != nil {
+				report.Rejected++
+				report.Errors = append(report.Errors, rowError{Row: row, Errors: map[string]string{"row": "run_at and expires_at are not supported in imports"}})
+				continue
+			}
+
+			if errs := data.Validate(); len(errs) > 0 {
+				report.Rejected++
+				report.Errors = append(report.Errors, rowError{Row: row, Errors: errs})
+				continue
+			}
+
+			// imports must not hold up users created interactively
+			msg := &queue.Message{
+				ID:       uuid.NewString(),
+				Type:     "user.create",
+				Payload:  map[string]any{"name": data.Name, "email": data.Email, "age": data.Age, "password": data.Password},
+				Priority: queue.PriorityLow,
+			}
+			msg.Encryption, err = encryption.Seal(r.Context(), kp, msg.ID, msg.Payload, encryption.TaggedFields(data))
+			if err != nil {
+				slog.Error("encrypting import row", "import_id", importID, "error", err)
+				abort(row, http.StatusInternalServerError, "internal server error")
+				return
+			}
+			chunk = append(chunk, msg)
+
+			if len(chunk) == importChunkSize {
+				if err := flush(row + 1); err != nil {
+					slog.Error("enqueuing import rows", "import_id", importID, "error", err)
+					fail(http.StatusInternalServerError, "internal server error")
+					return
+				}
+			}
+		}
+
+		// every row is read, row is one past the last
+		if err := flush(row); err != nil {
+			slog.Error("enqueuing import rows", "import_id", importID, "error", err)
+			fail(http.StatusInternalServerError, "internal server error")
+			return
+		}
+		report.Complete = true
+
+		if err := batch.Seal(r.Context(), db, importID, report.Accepted); err != nil {
+			slog.Error("sealing import", "import_id", importID, "error", err)
+			fail(http.StatusInternalServerError, "internal server error")
+			return
+		}
+		sealed = true
+
+		slog.Info("user import enqueued", "import_id", importID, "accepted", report.Accepted, "rejected", report.Rejected)
+		writeImportReport(w, http.StatusAccepted, report)
+	}
+}
+
+func writeImportReport(w http.ResponseWriter, status int, report importReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// enqueueImportChunk stores a child job per row together with
+// its outbox message
+func enqueueImportChunk(r *http.Request, db *pg.DB, importID string, chunk []*queue.Message) error {
+	if len(chunk) == 0 {
+		return nil
+	}
+
+	submitter := m.UserFromContext(r.Context())
+	jobs := make([]*models.Job, len(chunk))
+	for i, msg := range chunk {
+		jobs[i] = models.NewJob(msg.ID, msg.Type, importID)
+		jobs[i].Submitter = submitter
+	}
+
+	return db.RunInTransaction(r.Context(), func(tx *pg.Tx) error {
+		if err := models.InsertJobs(tx, jobs); err != nil {
+			return fmt.Errorf("inserting child jobs: %w", err)
+		}
+		return outbox.EnqueueMany(tx, chunk, 0)
+	})
+}
+
+func newRowReader(contentType string, body io.Reader) (rowReader, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content type: %w", err)
+	}
+
+	switch mediaType {
+	case "text/csv":
+		return csvRowReader(body)
+	case "application/x-ndjson", "application/ndjson":
+		return ndjsonRowReader(body), nil
+	default:
+		return nil, fmt.Errorf("unsupported content type %q, use text/csv or application/x-ndjson", mediaType)
+	}
+}
+
+func csvRowReader(body io.Reader) (rowReader, error) {
+	cr := csv.NewReader(body)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading csv header: %w", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, h := range header {
+		columns[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	for _, c := range []string{"name", "email", "password", "age"} {
+		if _, ok := columns[c]; !ok {
+			return nil, fmt.Errorf("csv header is missing the %q column", c)
+		}
+	}
+
+	return func() (validators.CreateUser, error) {
+		var data validators.CreateUser
+
+		record, err := cr.Read()
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				return data, invalidRowError{err}
+			}
+			return data, err
+		}
+
+		field := func(name string) string {
+			i := columns[name]
+			if i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+
+		data.Name = field("name")
+		data.Email = field("email")
+		data.Password = field("password")
+		if age := field("age"); age != "" {
+			data.Age, err = strconv.Atoi(age)
+			if err != nil {
+				return data, invalidRowError{fmt.Errorf("age must be a number")}
+			}
+		}
+		return data, nil
+	}, nil
+}
+
+func ndjsonRowReader(body io.Reader) rowReader {
+	sc := bufio.NewScanner(body)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	return func() (validators.CreateUser, error) {
+		var data validators.CreateUser
+
+		// every line is a row, so rows match the line numbers
+		if !sc.Scan() {
+			if err := sc.Err(); err != nil {
+				return data, err
+			}
+			return data, io.EOF
+		}
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			return data, errBlankRow
+		}
+		if err := json.Unmarshal([]byte(line), &data); err != nil {
+			return data, invalidRowError{fmt.Errorf("invalid JSON: %w", err)}
+		}
+		return data, nil
+	}
+}
+
+// userImportStatus aggregates the statuses of the jobs
+// created by an import
+func userImportStatus(db *pg.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		importID := r.PathValue("id")
+
+		job, err := models.GetJob(db, importID)
+		if errors.Is(err, pg.ErrNoRows) || (err == nil && job.Type != "user.import") {
+			http.Error(w, "import not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("getting import job", "import_id", importID, "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		counts, err := models.CountChildJobs(db, importID)
+		if err != nil {
+			slog.Error("counting import jobs", "import_id", importID, "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		total := 0
+		for _, c := range counts {
+			total += c
+		}
+
+		res := map[string]any{
+			"import_id":  importID,
+			"created_at": job.CreatedAt,
+			"total":      total,
+			"statuses":   counts,
+		}
+
+		b, err := batch.Get(r.Context(), db, importID)
+		if err != nil {
+			slog.Error("getting import batch", "import_id", importID, "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		res["progress"] = batchProgress(b)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestNDJSONRowsAreNumberedByLine(t *testing.T) {
+	body := strings.Join([]string{
+		`{"name":"a","email":"a@example.com"}`,
+		``,
+		`not json`,
+		`   `,
+		`{"name":"b","email":"b@example.com"}`,
+	}, "\n")
+	next := ndjsonRowReader(strings.NewReader(body))
+
+	var rowErr invalidRowError
+	want := []func(error) bool{
+		func(err error) bool { return err == nil },
+		func(err error) bool { return errors.Is(err, errBlankRow) },
+		func(err error) bool { return errors.As(err, &rowErr) },
+		func(err error) bool { return errors.Is(err, errBlankRow) },
+		func(err error) bool { return err == nil },
+		func(err error) bool { return errors.Is(err, io.EOF) },
+	}
+
+	for row, ok := range want {
+		data, err := next()
+		if !ok(err) {
+			t.Fatalf("row %d: unexpected error %v", row+1, err)
+		}
+		if row == 4 && data.Name != "b" {
+			t.Fatalf("row 5 = %+v, want b", data)
+		}
+	}
+}
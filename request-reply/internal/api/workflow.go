@@ -0,0 +1,76 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/serdarozerr/request-reply/internal/service/encryption"
+	"github.com/serdarozerr/request-reply/internal/service/workflow"
+	m "github.com/serdarozerr/request-reply/pkg/middleware"
+)
+
+// submitWorkflow starts a workflow, its state is read
+// from the jobs API with the returned job id
+func submitWorkflow(db *pg.DB, kp encryption.KeyProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		var def workflow.Definition
+		if err := json.NewDecoder(r.Body).Decode(&def); err != nil {
+			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		wf, err := workflow.Submit(r.Context(), db, kp, &def, m.UserFromContext(r.Context()))
+		if errors.Is(err, workflow.ErrInvalidDefinition) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			slog.Error("submitting workflow", "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("workflow submitted", "workflow_id", wf.WorkflowID, "steps", len(def.Steps), "failure_policy", wf.FailurePolicy)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{
+			"message": "check status with job id",
+			"job_id":  wf.WorkflowID,
+		})
+	}
+}
+
+// stuckSagas lists the sagas whose compensation failed or has been
+// running longer than older_than, 15m by default
+func stuckSagas(db *pg.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		olderThan := 15 * time.Minute
+		if v := r.URL.Query().Get("older_than"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "older_than must be a duration like 15m", http.StatusBadRequest)
+				return
+			}
+			olderThan = d
+		}
+
+		sagas, err := workflow.ListStuckSagas(r.Context(), db, olderThan)
+		if err != nil {
+			slog.Error("listing stuck sagas", "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if sagas == nil {
+			sagas = []*workflow.Workflow{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"sagas": sagas})
+	}
+}
@@ -0,0 +1,173 @@
+package database
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/serdarozerr/request-reply/internal/config"
+)
+
+// Connect opens the connection pool and pings the database,
+// retrying while it is not reachable yet
+func Connect(ctx context.Context, cfg config.DatabaseConfig) (*pg.DB, error) {
+
+	opt, err := Options(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	db := pg.Connect(opt)
+
+	retries := max(cfg.ConnectRetries, 0)
+	interval := config.Duration(cfg.ConnectRetryInterval, 2*time.Second)
+
+	for attempt := 0; ; attempt++ {
+		err = db.Ping(ctx)
+		if err == nil {
+			return db, nil
+		}
+		if attempt >= retries {
+			break
+		}
+
+		slog.Warn("database is not reachable, retrying", "attempt", attempt+1, "error", err)
+		select {
+		case <-ctx.Done():
+			db.Close()
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+
+	db.Close()
+	return nil, fmt.Errorf("pinging database: %w", err)
+}
+
+// Options builds the pg options from the URL and
+// the discrete fields, the latter win
+func Options(cfg config.DatabaseConfig) (*pg.Options, error) {
+	opt := &pg.Options{}
+	if cfg.URL != "" {
+		parsed, err := pg.ParseURL(cfg.URL)
+		if err != nil {
+			return nil, fmt.Errorf("parsing database url: %w", err)
+		}
+		opt = parsed
+	}
+
+	host, port, _ := net.SplitHostPort(opt.Addr)
+	if cfg.Host != "" {
+		host = cfg.Host
+	}
+	if cfg.Port != "" {
+		port = cfg.Port
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	if port == "" {
+		port = "5432"
+	}
+	opt.Addr = net.JoinHostPort(host, port)
+
+	if cfg.User != "" {
+		opt.User = cfg.User
+	}
+	if cfg.Password != "" {
+		opt.Password = cfg.Password
+	}
+	if cfg.Name != "" {
+		opt.Database = cfg.Name
+	}
+	if opt.Database == "" {
+		return nil, fmt.Errorf("database name is not configured")
+	}
+
+	if cfg.SSLMode != "" {
+		tlsConfig, err := tlsConfig(cfg.SSLMode, host, cfg.SSLRootCert)
+		if err != nil {
+			return nil, err
+		}
+		opt.TLSConfig = tlsConfig
+	}
+
+	if cfg.PoolSize > 0 {
+		opt.PoolSize = cfg.PoolSize
+	}
+	if cfg.MinIdleConns > 0 {
+		opt.MinIdleConns = cfg.MinIdleConns
+	}
+	opt.PoolTimeout = config.Duration(cfg.PoolTimeout, 0)
+	opt.DialTimeout = config.Duration(cfg.DialTimeout, 5*time.Second)
+	opt.ReadTimeout = config.Duration(cfg.ReadTimeout, 0)
+	opt.WriteTimeout = config.Duration(cfg.WriteTimeout, 0)
+
+	return opt, nil
+}
+
+func tlsConfig(sslMode, host, rootCert string) (*tls.Config, error) {
+	switch sslMode {
+	case "disable":
+		return nil, nil
+	case "require":
+		// encrypted, the certificate is not verified
+		return &tls.Config{InsecureSkipVerify: true}, nil //nolint:gosec
+	case "verify-ca", "verify-full":
+	default:
+		return nil, fmt.Errorf("sslmode %q is not supported, use disable, require, verify-ca or verify-full", sslMode)
+	}
+
+	roots, err := loadRootCerts(rootCert)
+	if err != nil {
+		return nil, err
+	}
+
+	if sslMode == "verify-full" {
+		return &tls.Config{ServerName: host, RootCAs: roots}, nil
+	}
+
+	// verify-ca checks the chain but not the host name, the
+	// default verification is skipped and done here instead
+	return &tls.Config{
+		InsecureSkipVerify: true, //nolint:gosec
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range cs.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+			})
+			return err
+		},
+	}, nil
+}
+
+// loadRootCerts returns nil for an empty path,
+// which means the system pool
+func loadRootCerts(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading sslrootcert: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("sslrootcert %s has no PEM certificates", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,303 @@
+package database
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+// every migrator takes this advisory lock, so pods
+// starting together don't apply the same migration
+const migrationLockKey = 724058193401
+
+var (
+	migrationFileRe   = regexp.MustCompile(`^(\d{14})_([a-zA-Z0-9_]+)\.sql$`)
+	migrationMarkerRe = regexp.MustCompile(`(?i)^--\s*\+migrate\s+(up|down)\s*$`)
+)
+
+// Migration is a migrations/<version>_<name>.sql file, the statements
+// after a "-- +migrate down" line revert the ones before it
+type Migration struct {
+	Version string
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Migration
+	AppliedAt time.Time
+}
+
+func (s MigrationStatus) Applied() bool {
+	return !s.AppliedAt.IsZero()
+}
+
+type appliedMigration struct {
+	tableName struct{} `pg:"schema_migrations"`
+
+	Version   string    `pg:"version,pk"`
+	Name      string    `pg:"name"`
+	AppliedAt time.Time `pg:"applied_at"`
+}
+
+// LoadMigrations reads the migrations in fsys ordered by version
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("reading migrations: %w", err)
+	}
+
+	var migrations []Migration
+	for _, e := range entries {
+		match := migrationFileRe.FindStringSubmatch(e.Name())
+		if e.IsDir() || match == nil {
+			continue
+		}
+
+		data, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, fmt.Errorf("reading migration %s: %w", e.Name(), err)
+		}
+
+		m := Migration{Version: match[1], Name: match[2]}
+		m.Up, m.Down = splitMigration(string(data))
+		migrations = append(migrations, m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+func splitMigration(sql string) (up, down string) {
+	var (
+		sections = map[string]*strings.Builder{"up": {}, "down": {}}
+		current  = sections["up"]
+	)
+
+	sc := bufio.NewScanner(strings.NewReader(sql))
+	for sc.Scan() {
+		line := sc.Text()
+		if m := migrationMarkerRe.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			current = sections[strings.ToLower(m[1])]
+			continue
+		}
+		current.WriteString(line)
+		current.WriteByte('\n')
+	}
+	return strings.TrimSpace(sections["up"].String()), strings.TrimSpace(sections["down"].String())
+}
+
+// CreateMigration writes an empty migration file into dir
+func CreateMigration(dir, name string) (string, error) {
+	if !regexp.MustCompile(`^[a-zA-Z0-9_]+$`).MatchString(name) {
+		return "", fmt.Errorf("migration name may only contain letters, digits and underscores")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("creating migrations directory: %w", err)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%s_%s.sql", time.Now().UTC().Format("20060102150405"), name))
+	content := "-- +migrate up\n\n\n-- +migrate down\n\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		return "", fmt.Errorf("writing migration: %w", err)
+	}
+	return path, nil
+}
+
+type Migrator struct {
+	db         *pg.DB
+	migrations []Migration
+}
+
+func NewMigrator(db *pg.DB, migrations []Migration) *Migrator {
+	return &Migrator{db: db, migrations: migrations}
+}
+
+// Up applies every pending migration, each in its own transaction
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var applied []Migration
+
+	err := m.withLock(ctx, func(conn *pg.Conn) error {
+		done, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.migrations {
+			if _, ok := done[mig.Version]; ok {
+				continue
+			}
+
+			err := conn.RunInTransaction(ctx, func(tx *pg.Tx) error {
+				if mig.Up != "" {
+					if _, err := tx.ExecContext(ctx, mig.Up); err != nil {
+						return err
+					}
+				}
+				_, err := tx.ModelContext(ctx, &appliedMigration{
+					Version:   mig.Version,
+					Name:      mig.Name,
+					AppliedAt: time.Now().UTC(),
+				}).Insert()
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("applying migration %s_%s: %w", mig.Version, mig.Name, err)
+			}
+			applied = append(applied, mig)
+		}
+		return nil
+	})
+
+	return applied, err
+}
+
+// Down reverts the most recently applied migration,
+// it returns nil when nothing is applied
+func (m *Migrator) Down(ctx context.Context) (*Migration, error) {
+	var reverted *Migration
+
+	err := m.withLock(ctx, func(conn *pg.Conn) error {
+		done, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mig := m.migrations[i]
+			if _, ok := done[mig.Version]; !ok {
+				continue
+			}
+			if mig.Down == "" {
+				return fmt.Errorf("migration %s_%s has no down section", mig.Version, mig.Name)
+			}
+
+			err := conn.RunInTransaction(ctx, func(tx *pg.Tx) error {
+				if _, err := tx.ExecContext(ctx, mig.Down); err != nil {
+					return err
+				}
+				_, err := tx.ModelContext(ctx, &appliedMigration{Version: mig.Version}).WherePK().Delete()
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("reverting migration %s_%s: %w", mig.Version, mig.Name, err)
+			}
+			reverted = &mig
+			return nil
+		}
+		return nil
+	})
+
+	return reverted, err
+}
+
+// Baseline records every migration up to and including version as
+// applied without running it, for adopting a database whose schema
+// was created by hand. It returns the newly recorded migrations
+func (m *Migrator) Baseline(ctx context.Context, version string) ([]Migration, error) {
+	var marked []Migration
+
+	err := m.withLock(ctx, func(conn *pg.Conn) error {
+		known := false
+		for _, mig := range m.migrations {
+			if mig.Version == version {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown migration version %s", version)
+		}
+
+		done, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.migrations {
+			if mig.Version > version {
+				break
+			}
+			if _, ok := done[mig.Version]; ok {
+				continue
+			}
+			_, err := conn.ModelContext(ctx, &appliedMigration{
+				Version:   mig.Version,
+				Name:      mig.Name,
+				AppliedAt: time.Now().UTC(),
+			}).Insert()
+			if err != nil {
+				return fmt.Errorf("recording migration %s_%s: %w", mig.Version, mig.Name, err)
+			}
+			marked = append(marked, mig)
+		}
+		return nil
+	})
+
+	return marked, err
+}
+
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+
+	err := m.withLock(ctx, func(conn *pg.Conn) error {
+		done, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			statuses = append(statuses, MigrationStatus{Migration: mig, AppliedAt: done[mig.Version]})
+		}
+		return nil
+	})
+
+	return statuses, err
+}
+
+// withLock runs fn on a single connection holding the migration lock
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *pg.Conn) error) error {
+	conn := m.db.Conn()
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock(?)", migrationLockKey); err != nil {
+		return fmt.Errorf("taking migration lock: %w", err)
+	}
+	// the lock is also released when the connection closes
+	defer conn.ExecContext(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock(?)", migrationLockKey)
+
+	_, err := conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations(
+			version VARCHAR(14) PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+	if err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	return fn(conn)
+}
+
+func (m *Migrator) applied(ctx context.Context, conn *pg.Conn) (map[string]time.Time, error) {
+	var rows []appliedMigration
+	if err := conn.ModelContext(ctx, &rows).Select(); err != nil {
+		return nil, fmt.Errorf("reading applied migrations: %w", err)
+	}
+
+	done := make(map[string]time.Time, len(rows))
+	for _, r := range rows {
+		done[r.Version] = r.AppliedAt
+	}
+	return done, nil
+}
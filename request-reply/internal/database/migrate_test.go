@@ -0,0 +1,65 @@
+package database
+
+import (
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/serdarozerr/request-reply/migrations"
+)
+
+func TestSplitMigration(t *testing.T) {
+	up, down := splitMigration("-- +migrate up\nCREATE TABLE a(id INT);\n\n-- +migrate down\nDROP TABLE a;\n")
+	if up != "CREATE TABLE a(id INT);" {
+		t.Errorf("up = %q", up)
+	}
+	if down != "DROP TABLE a;" {
+		t.Errorf("down = %q", down)
+	}
+
+	// files without markers are all up
+	up, down = splitMigration("CREATE TABLE a(id INT);")
+	if up != "CREATE TABLE a(id INT);" || down != "" {
+		t.Errorf("up = %q, down = %q", up, down)
+	}
+}
+
+func TestLoadMigrationsOrdersByVersion(t *testing.T) {
+	fsys := fstest.MapFS{
+		"20260102000000_second.sql": {Data: []byte("-- +migrate up\nSELECT 2;")},
+		"20260101000000_first.sql":  {Data: []byte("-- +migrate up\nSELECT 1;")},
+		"README.md":                 {Data: []byte("not a migration")},
+	}
+
+	ms, err := LoadMigrations(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 2 || ms[0].Name != "first" || ms[1].Name != "second" {
+		t.Fatalf("got %+v, want first and second in order", ms)
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	ms, err := LoadMigrations(migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+
+	seen := make(map[string]bool)
+	for _, m := range ms {
+		if seen[m.Version] {
+			t.Errorf("version %s is used twice", m.Version)
+		}
+		seen[m.Version] = true
+		if _, err := time.Parse("20060102150405", m.Version); err != nil {
+			t.Errorf("version %s is not a timestamp, create migrations with migrate create", m.Version)
+		}
+		if m.Up == "" || m.Down == "" {
+			t.Errorf("migration %s_%s needs an up and a down section", m.Version, m.Name)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"time"
+
+	"github.com/go-pg/pg/v10/orm"
+)
+
+// JobAttempt is one processing attempt of a job by a worker
+type JobAttempt struct{
+	ID int64 `pg:"id,pk" json:"-"`
+	JobID string `pg:"job_id" json:"job_id"`
+	Attempt int `pg:"attempt" json:"attempt"`
+	WorkerID string `pg:"worker_id" json:"worker_id"`
+	Status string `pg:"status" json:"status"`
+	Error string `pg:"error" json:"error,omitempty"`
+	StartedAt time.Time `pg:"started_at" json:"started_at"`
+	FinishedAt time.Time `pg:"finished_at" json:"finished_at,omitzero"`
+	DurationMs int64 `pg:"duration_ms" json:"duration_ms,omitempty"`
+}
+
+func InsertJobAttempt(db orm.DB, attempt *JobAttempt)error{
+	_,err:=db.Model(attempt).Insert()
+	return err
+}
+
+// FinishJobAttempt records the outcome of a running attempt
+func FinishJobAttempt(db orm.DB, jobID string, attempt int, status string, errMsg string)error{
+	now := time.Now().UTC()
+	_, err := db.Model((*JobAttempt)(nil)).
+		Set("status = ?", status).
+		Set("error = ?", errMsg).
+		Set("finished_at = ?", now).
+		Set("duration_ms = (EXTRACT(EPOCH FROM (?::timestamptz - started_at)) * 1000)::bigint", now).
+		Where("job_id = ? AND attempt = ?", jobID, attempt).
+		Update()
+	return err
+}
+
+func ListJobAttempts(db orm.DB, jobID string)([]*JobAttempt, error){
+	var attempts []*JobAttempt
+	err := db.Model(&attempts).Where("job_id = ?", jobID).Order("attempt").Select()
+	return attempts, err
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+)
+
+// JobResult is the output of a succeeded job, small results are
+// kept inline byte for byte, the others in the blob store under
+// BlobRef. Purged results keep their row without the data
+type JobResult struct{
+	JobID string `pg:"job_id,pk" json:"job_id"`
+	ContentType string `pg:"content_type" json:"content_type"`
+	SizeBytes int64 `pg:"size_bytes,use_zero" json:"size_bytes"`
+	Inline []byte `pg:"inline,type:bytea" json:"-"`
+	BlobRef string `pg:"blob_ref" json:"-"`
+	CreatedAt time.Time `pg:"created_at" json:"created_at"`
+	ExpiresAt time.Time `pg:"expires_at" json:"expires_at"`
+	PurgedAt time.Time `pg:"purged_at" json:"purged_at,omitzero"`
+}
+
+// SaveJobResult stores the result, replacing the one of an earlier attempt
+func SaveJobResult(db orm.DB, result *JobResult)error{
+	_, err := db.Model(result).
+		OnConflict("(job_id) DO UPDATE").
+		Set("content_type = EXCLUDED.content_type").
+		Set("size_bytes = EXCLUDED.size_bytes").
+		Set("inline = EXCLUDED.inline").
+		Set("blob_ref = EXCLUDED.blob_ref").
+		Set("created_at = EXCLUDED.created_at").
+		Set("expires_at = EXCLUDED.expires_at").
+		Set("purged_at = NULL").
+		Insert()
+	return err
+}
+
+func GetJobResult(db orm.DB, jobID string)(*JobResult, error){
+	result := new(JobResult)
+	err := db.Model(result).Where("job_id = ?", jobID).Select()
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ListExpiredJobResults returns up to limit results expired
+// before now that still have their data
+func ListExpiredJobResults(db orm.DB, now time.Time, limit int)([]*JobResult, error){
+	var results []*JobResult
+	err := db.Model(&results).
+		Column("job_id", "blob_ref").
+		Where("expires_at < ?", now).
+		Where("purged_at IS NULL").
+		Order("expires_at").
+		Limit(limit).
+		Select()
+	return results, err
+}
+
+// PurgeJobResults drops the data of the results, the row stays as
+// a tombstone so the result is reported expired instead of missing
+func PurgeJobResults(db orm.DB, jobIDs []string)(int, error){
+	if len(jobIDs) == 0 {
+		return 0, nil
+	}
+	res, err := db.Model((*JobResult)(nil)).
+		Set("inline = NULL").
+		Set("blob_ref = NULL").
+		Set("purged_at = now()").
+		Where("job_id IN (?)", pg.In(jobIDs)).
+		Update()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected(), nil
+}
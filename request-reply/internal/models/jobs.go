@@ -1,18 +1,239 @@
 package models
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
 	"time"
 
 	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
 )
 
+const (
+	// waiting in the scheduler for its run_at
+	JobStatusScheduled = "scheduled"
+	JobStatusQueued    = "queued"
+	JobStatusReceived  = "received"
+	JobStatusRunning   = "running"
+	JobStatusRetrying  = "retrying"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+	JobStatusDead      = "dead"
+	JobStatusCancelled = "cancelled"
+)
+
+var ErrInvalidTransition = errors.New("invalid job status transition")
+
+// allowed moves of the job state machine, statuses
+// missing as a key are terminal
+var jobTransitions = map[string][]string{
+	JobStatusScheduled: {JobStatusQueued, JobStatusCancelled},
+	// failed when its message can't be delivered
+	JobStatusQueued:   {JobStatusReceived, JobStatusFailed, JobStatusCancelled},
+	JobStatusReceived: {JobStatusRunning, JobStatusRetrying, JobStatusFailed, JobStatusDead, JobStatusCancelled},
+	// back to received when a worker died mid run and
+	// the message was delivered to another one
+	JobStatusRunning:  {JobStatusSucceeded, JobStatusFailed, JobStatusRetrying, JobStatusDead, JobStatusCancelled, JobStatusReceived},
+	JobStatusRetrying: {JobStatusReceived, JobStatusDead, JobStatusCancelled},
+}
+
+func CanTransition(from, to string) bool {
+	for _, s := range jobTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+func IsTerminal(status string) bool {
+	_, ok := jobTransitions[status]
+	return !ok
+}
+
+// statusesTo lists the statuses that can move to status, sorted
+func statusesTo(status string) []string {
+	var from []string
+	for s := range jobTransitions {
+		if CanTransition(s, status) {
+			from = append(from, s)
+		}
+	}
+	slices.Sort(from)
+	return from
+}
+
 type Job struct{
-	JobID string `pg:"job_id,unique"`
-	Status string `pg:"status"`
-	CreatedAt time.Time `pg:"created_at"`
+	ID int64 `pg:"id,pk" json:"-"`
+	JobID string `pg:"job_id,unique" json:"job_id"`
+	Type string `pg:"type,use_zero" json:"type"`
+	ParentID string `pg:"parent_id" json:"parent_id,omitempty"`
+	Status string `pg:"status" json:"status"`
+	Attempts int `pg:"attempts,use_zero" json:"attempts"`
+	LastError string `pg:"last_error" json:"last_error,omitempty"`
+	WorkerID string `pg:"worker_id" json:"worker_id,omitempty"`
+	Submitter string `pg:"submitter" json:"submitter,omitempty"`
+	RunAt time.Time `pg:"run_at" json:"run_at,omitzero"`
+	CreatedAt time.Time `pg:"created_at" json:"created_at"`
+	QueuedAt time.Time `pg:"queued_at" json:"queued_at,omitzero"`
+	ReceivedAt time.Time `pg:"received_at" json:"received_at,omitzero"`
+	StartedAt time.Time `pg:"started_at" json:"started_at,omitzero"`
+	FinishedAt time.Time `pg:"finished_at" json:"finished_at,omitzero"`
+	CancelledAt time.Time `pg:"cancelled_at" json:"cancelled_at,omitzero"`
+	UpdatedAt time.Time `pg:"updated_at" json:"updated_at,omitzero"`
 }
 
-func InsertJob(pg *pg.DB, job *Job)error{
+// NewJob returns a queued job
+func NewJob(jobID, jobType, parentID string) *Job {
+	now := time.Now().UTC()
+	return &Job{
+		JobID:     jobID,
+		Type:      jobType,
+		ParentID:  parentID,
+		Status:    JobStatusQueued,
+		CreatedAt: now,
+		QueuedAt:  now,
+		UpdatedAt: now,
+	}
+}
+
+func InsertJob(pg orm.DB, job *Job)error{
 	_,err:=pg.Model(job).Insert()
 	return err
-}
\ No newline at end of file
+}
+
+func InsertJobs(db orm.DB, jobs []*Job)error{
+	if len(jobs) == 0 {
+		return nil
+	}
+	_,err:=db.Model(&jobs).Insert()
+	return err
+}
+
+func GetJob(db orm.DB, jobID string)(*Job, error){
+	job := new(Job)
+	err := db.Model(job).Where("job_id = ?", jobID).Select()
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// TransitionJob moves the job to status with the row locked, update
+// can change other fields before the job is saved. It returns
+// ErrInvalidTransition when the state machine doesn't allow the move
+func TransitionJob(ctx context.Context, db *pg.DB, jobID string, status string, update func(job *Job))(*Job, error){
+	var job *Job
+
+	err := db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		job = new(Job)
+		err := tx.ModelContext(ctx, job).Where("job_id = ?", jobID).For("UPDATE").Select()
+		if err != nil {
+			return err
+		}
+		if err := Transition(job, status); err != nil {
+			return err
+		}
+		if update != nil {
+			update(job)
+		}
+		return UpdateJob(tx, job)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Transition changes the status in memory and stamps the
+// matching time, the caller saves the job
+func Transition(job *Job, status string) error {
+	if !CanTransition(job.Status, status) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, job.Status, status)
+	}
+
+	now := time.Now().UTC()
+	job.Status = status
+	job.UpdatedAt = now
+
+	switch status {
+	case JobStatusQueued:
+		job.QueuedAt = now
+	case JobStatusReceived:
+		job.ReceivedAt = now
+	case JobStatusRunning:
+		job.StartedAt = now
+	case JobStatusSucceeded, JobStatusFailed, JobStatusDead:
+		job.FinishedAt = now
+	case JobStatusCancelled:
+		job.CancelledAt = now
+		job.FinishedAt = now
+	}
+	return nil
+}
+
+// UpdateJob saves every field of the job
+func UpdateJob(db orm.DB, job *Job)error{
+	_, err := db.Model(job).
+		ExcludeColumn("id", "job_id", "created_at").
+		Where("job_id = ?", job.JobID).
+		Update()
+	return err
+}
+
+// CountChildJobs returns the number of child jobs per status
+func CountChildJobs(db orm.DB, parentID string)(map[string]int, error){
+	var rows []struct {
+		Status string
+		Count  int
+	}
+	err := db.Model((*Job)(nil)).
+		Column("status").
+		ColumnExpr("count(*) AS count").
+		Where("parent_id = ?", parentID).
+		Group("status").
+		Select(&rows)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int, len(rows))
+	for _, r := range rows {
+		counts[r.Status] = r.Count
+	}
+	return counts, nil
+}
+
+// CancelChildJobs cancels the unfinished child jobs of parentID, it
+// returns the ids of the ones that were being processed and the
+// number of cancelled jobs
+func CancelChildJobs(db orm.DB, parentID string)([]string, int, error){
+	unfinished := statusesTo(JobStatusCancelled)
+
+	var running []string
+	err := db.Model((*Job)(nil)).
+		Column("job_id").
+		Where("parent_id = ?", parentID).
+		Where("status IN (?)", pg.In([]string{JobStatusReceived, JobStatusRunning})).
+		For("UPDATE").
+		Select(&running)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	now := time.Now().UTC()
+	res, err := db.Model((*Job)(nil)).
+		Set("status = ?", JobStatusCancelled).
+		Set("cancelled_at = ?", now).
+		Set("finished_at = ?", now).
+		Set("updated_at = ?", now).
+		Where("parent_id = ?", parentID).
+		Where("status IN (?)", pg.In(unfinished)).
+		Update()
+	if err != nil {
+		return nil, 0, err
+	}
+	return running, res.RowsAffected(), nil
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+var allStatuses = []string{
+	JobStatusScheduled, JobStatusQueued, JobStatusReceived, JobStatusRunning, JobStatusRetrying,
+	JobStatusSucceeded, JobStatusFailed, JobStatusDead, JobStatusCancelled,
+}
+
+func TestJobTransitionsUseKnownStatuses(t *testing.T) {
+	for from, tos := range jobTransitions {
+		if !slices.Contains(allStatuses, from) {
+			t.Errorf("unknown status %q", from)
+		}
+		for _, to := range tos {
+			if !slices.Contains(allStatuses, to) {
+				t.Errorf("%s -> unknown status %q", from, to)
+			}
+		}
+	}
+}
+
+func TestIsTerminal(t *testing.T) {
+	terminal := []string{JobStatusSucceeded, JobStatusFailed, JobStatusDead, JobStatusCancelled}
+	for _, s := range allStatuses {
+		if got, want := IsTerminal(s), slices.Contains(terminal, s); got != want {
+			t.Errorf("IsTerminal(%s) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{JobStatusQueued, JobStatusReceived, true},
+		{JobStatusQueued, JobStatusFailed, true},
+		{JobStatusQueued, JobStatusRunning, false},
+		{JobStatusRunning, JobStatusSucceeded, true},
+		{JobStatusRunning, JobStatusReceived, true},
+		{JobStatusRetrying, JobStatusReceived, true},
+		{JobStatusRetrying, JobStatusSucceeded, false},
+		{JobStatusScheduled, JobStatusQueued, true},
+		{JobStatusSucceeded, JobStatusCancelled, false},
+		{JobStatusCancelled, JobStatusQueued, false},
+	}
+	for _, tt := range tests {
+		if got := CanTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("CanTransition(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestEveryUnfinishedStatusCanBeCancelled(t *testing.T) {
+	var unfinished []string
+	for _, s := range allStatuses {
+		if !IsTerminal(s) {
+			unfinished = append(unfinished, s)
+		}
+	}
+	slices.Sort(unfinished)
+
+	if got := statusesTo(JobStatusCancelled); !slices.Equal(got, unfinished) {
+		t.Fatalf("statusesTo(cancelled) = %v, want %v", got, unfinished)
+	}
+}
+
+func TestTransition(t *testing.T) {
+	job := NewJob("job", "user.create", "")
+
+	if err := Transition(job, JobStatusSucceeded); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("got %v, want ErrInvalidTransition", err)
+	}
+	if job.Status != JobStatusQueued {
+		t.Fatalf("status %s after a rejected transition, want it unchanged", job.Status)
+	}
+
+	for _, s := range []string{JobStatusReceived, JobStatusRunning, JobStatusSucceeded} {
+		if err := Transition(job, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if job.ReceivedAt.IsZero() || job.StartedAt.IsZero() || job.FinishedAt.IsZero() {
+		t.Fatalf("timestamps not stamped: %+v", job)
+	}
+}
@@ -0,0 +1,104 @@
+package models
+
+import (
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+)
+
+// JobCursor is the position of the last job of a page
+type JobCursor struct {
+	CreatedAt time.Time
+	ID        int64
+}
+
+type JobFilter struct {
+	Types     []string
+	Statuses  []string
+	Submitter string
+	ParentID  string
+	// created_at range, zero values are open ends
+	From time.Time
+	To   time.Time
+}
+
+type JobListOptions struct {
+	JobFilter
+	// newest first when true
+	Desc  bool
+	Limit int
+	After *JobCursor
+}
+
+func (f JobFilter) apply(q *orm.Query) *orm.Query {
+	if len(f.Types) > 0 {
+		q = q.Where("type IN (?)", pg.In(f.Types))
+	}
+	if len(f.Statuses) > 0 {
+		q = q.Where("status IN (?)", pg.In(f.Statuses))
+	}
+	if f.Submitter != "" {
+		q = q.Where("submitter = ?", f.Submitter)
+	}
+	if f.ParentID != "" {
+		q = q.Where("parent_id = ?", f.ParentID)
+	}
+	if !f.From.IsZero() {
+		q = q.Where("created_at >= ?", f.From)
+	}
+	if !f.To.IsZero() {
+		q = q.Where("created_at < ?", f.To)
+	}
+	return q
+}
+
+// ListJobs returns a page of jobs ordered by (created_at, id), the
+// cursor of the next page is nil when there are no more jobs
+func ListJobs(db orm.DB, opts JobListOptions) ([]*Job, *JobCursor, error) {
+	var jobs []*Job
+
+	q := opts.JobFilter.apply(db.Model(&jobs))
+
+	op, dir := ">", "ASC"
+	if opts.Desc {
+		op, dir = "<", "DESC"
+	}
+	if opts.After != nil {
+		q = q.Where("(created_at, id) "+op+" (?, ?)", opts.After.CreatedAt, opts.After.ID)
+	}
+
+	// one extra row tells whether there is a next page
+	err := q.OrderExpr("created_at " + dir + ", id " + dir).
+		Limit(opts.Limit + 1).
+		Select()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var next *JobCursor
+	if len(jobs) > opts.Limit {
+		jobs = jobs[:opts.Limit]
+		last := jobs[len(jobs)-1]
+		next = &JobCursor{CreatedAt: last.CreatedAt, ID: last.ID}
+	}
+	return jobs, next, nil
+}
+
+type JobCount struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	Count  int    `json:"count"`
+}
+
+// CountJobs returns the number of jobs per type and status
+func CountJobs(db orm.DB, f JobFilter) ([]JobCount, error) {
+	var counts []JobCount
+	err := f.apply(db.Model((*Job)(nil))).
+		Column("type", "status").
+		ColumnExpr("count(*) AS count").
+		Group("type", "status").
+		Order("type", "status").
+		Select(&counts)
+	return counts, err
+}
@@ -1,16 +1,52 @@
 package models
 
 import (
+	"errors"
+
 	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
 )
+
+// unique_violation, https://www.postgresql.org/docs/current/errcodes-appendix.html
+const uniqueViolation = "23505"
+
+var ErrEmailTaken = errors.New("email is already registered")
+
 type User struct{
+	ID int64 `pg:"id,pk"`
 	Name string `pg:"name"`
 	Email string `pg:"email,unique"`
 	Age uint `pg:"age"`
+	// bcrypt hash, never the plain password
+	Password string `pg:"password"`
+	// job that created the user
+	JobID string `pg:"job_id"`
 }
 
-func InsertUser(pg *pg.DB, user *User)error{
-	_,err:=pg.Model(user).Insert()
+// InsertUser returns ErrEmailTaken when the email is in use
+func InsertUser(db orm.DB, user *User)error{
+	_,err:=db.Model(user).Insert()
+	var pgErr pg.Error
+	if errors.As(err, &pgErr) && pgErr.Field('C') == uniqueViolation {
+		return ErrEmailTaken
+	}
 	return err
 }
 
+func GetUserByEmail(db orm.DB, email string)(*User, error){
+	user:=new(User)
+	err:=db.Model(user).Where("email = ?", email).Select()
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// DeleteUserByEmail reports whether a user was deleted
+func DeleteUserByEmail(db orm.DB, email string)(bool, error){
+	res,err:=db.Model((*User)(nil)).Where("email = ?", email).Delete()
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
@@ -0,0 +1,234 @@
+package batch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/google/uuid"
+	"github.com/serdarozerr/request-reply/internal/models"
+	"github.com/serdarozerr/request-reply/internal/service/outbox"
+	"github.com/serdarozerr/request-reply/internal/service/queue"
+)
+
+// type of the message that posts the summary to the callback url
+const CallbackType = "batch.callback"
+
+// Batch counts the terminal child jobs of a parent job, once every
+// child is done the completion message and callback are enqueued
+type Batch struct {
+	tableName struct{} `pg:"batches"`
+
+	BatchID   string `pg:"batch_id,pk" json:"batch_id"`
+	Total     int    `pg:"total,use_zero" json:"total"`
+	Succeeded int    `pg:"succeeded,use_zero" json:"succeeded"`
+	Failed    int    `pg:"failed,use_zero" json:"failed"`
+	Cancelled int    `pg:"cancelled,use_zero" json:"cancelled"`
+	// children are still being added while false,
+	// the batch can't complete before it is sealed
+	Sealed      bool           `pg:"sealed,use_zero" json:"sealed"`
+	OnComplete  *queue.Message `pg:"on_complete,type:jsonb" json:"-"`
+	CallbackURL string         `pg:"callback_url" json:"callback_url,omitempty"`
+	CreatedAt   time.Time      `pg:"created_at" json:"created_at"`
+	CompletedAt time.Time      `pg:"completed_at" json:"completed_at,omitzero"`
+}
+
+func (b *Batch) Done() int {
+	return b.Succeeded + b.Failed + b.Cancelled
+}
+
+func (b *Batch) complete() bool {
+	return b.Sealed && b.Done() >= b.Total
+}
+
+// Summary is the payload of the completion message and callback
+func (b *Batch) Summary() map[string]any {
+	return map[string]any{
+		"batch_id":  b.BatchID,
+		"total":     b.Total,
+		"succeeded": b.Succeeded,
+		"failed":    b.Failed,
+		"cancelled": b.Cancelled,
+	}
+}
+
+// Create inserts the parent job, running until the batch completes,
+// and the batch. Children are added with the parent job id as their
+// parent_id, Seal the batch once all of them are
+func Create(db orm.DB, b *Batch, jobType, submitter string) error {
+	if b.BatchID == "" {
+		b.BatchID = uuid.NewString()
+	}
+	b.CreatedAt = time.Now().UTC()
+
+	parent := models.NewJob(b.BatchID, jobType, "")
+	parent.Submitter = submitter
+	for _, status := range []string{models.JobStatusReceived, models.JobStatusRunning} {
+		if err := models.Transition(parent, status); err != nil {
+			return err
+		}
+	}
+	if err := models.InsertJob(db, parent); err != nil {
+		return fmt.Errorf("inserting batch job: %w", err)
+	}
+
+	if _, err := db.Model(b).Insert(); err != nil {
+		return fmt.Errorf("inserting batch: %w", err)
+	}
+	return nil
+}
+
+// Seal fixes the number of children, children finished
+// before it are already counted
+func Seal(ctx context.Context, db *pg.DB, batchID string, total int) error {
+	return db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		return seal(ctx, tx, batchID, total)
+	})
+}
+
+func seal(ctx context.Context, tx *pg.Tx, batchID string, total int) error {
+	b, err := lock(ctx, tx, batchID)
+	if err != nil {
+		return err
+	}
+	b.Total = total
+	b.Sealed = true
+	if _, err := tx.ModelContext(ctx, b).Column("total", "sealed").WherePK().Update(); err != nil {
+		return fmt.Errorf("sealing batch: %w", err)
+	}
+	return completeIfDone(ctx, tx, b)
+}
+
+func Get(ctx context.Context, db orm.DB, batchID string) (*Batch, error) {
+	b := new(Batch)
+	err := db.ModelContext(ctx, b).Where("batch_id = ?", batchID).Select()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ChildFinished counts a child job that reached a terminal status, call
+// it in the transaction finishing the job. Jobs that are not children
+// of a batch are ignored
+func ChildFinished(ctx context.Context, tx *pg.Tx, job *models.Job) error {
+	column := ""
+	switch job.Status {
+	case models.JobStatusSucceeded:
+		column = "succeeded"
+	case models.JobStatusFailed, models.JobStatusDead:
+		column = "failed"
+	case models.JobStatusCancelled:
+		column = "cancelled"
+	default:
+		return nil
+	}
+	return count(ctx, tx, job.ParentID, column, 1)
+}
+
+// ChildrenCancelled counts n children cancelled together
+func ChildrenCancelled(ctx context.Context, tx *pg.Tx, parentID string, n int) error {
+	if n == 0 {
+		return nil
+	}
+	return count(ctx, tx, parentID, "cancelled", n)
+}
+
+// count increments the counter in place, concurrent
+// workers are serialized on the batch row
+func count(ctx context.Context, tx *pg.Tx, batchID, column string, n int) error {
+	if batchID == "" {
+		return nil
+	}
+
+	b := new(Batch)
+	_, err := tx.ModelContext(ctx, b).
+		Set("? = ? + ?", pg.Ident(column), pg.Ident(column), n).
+		Where("batch_id = ?", batchID).
+		Returning("*").
+		Update()
+	if errors.Is(err, pg.ErrNoRows) || (err == nil && b.BatchID == "") {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("counting batch child: %w", err)
+	}
+	return completeIfDone(ctx, tx, b)
+}
+
+func lock(ctx context.Context, tx *pg.Tx, batchID string) (*Batch, error) {
+	b := new(Batch)
+	err := tx.ModelContext(ctx, b).Where("batch_id = ?", batchID).For("UPDATE").Select()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// completeIfDone finishes the parent job and enqueues the completion
+// message and the callback once every child is done
+func completeIfDone(ctx context.Context, tx *pg.Tx, b *Batch) error {
+	if !b.complete() || !b.CompletedAt.IsZero() {
+		return nil
+	}
+
+	b.CompletedAt = time.Now().UTC()
+	if _, err := tx.ModelContext(ctx, b).Column("completed_at").WherePK().Update(); err != nil {
+		return fmt.Errorf("completing batch: %w", err)
+	}
+	slog.Info("batch completed", "batch_id", b.BatchID, "total", b.Total, "succeeded", b.Succeeded, "failed", b.Failed, "cancelled", b.Cancelled)
+
+	var messages []*queue.Message
+	if b.OnComplete != nil {
+		msg := *b.OnComplete
+		msg.ID = uuid.NewString()
+		msg.Payload = make(map[string]any, len(b.OnComplete.Payload)+1)
+		for k, v := range b.OnComplete.Payload {
+			msg.Payload[k] = v
+		}
+		msg.Payload["batch"] = b.Summary()
+		messages = append(messages, &msg)
+	}
+	if b.CallbackURL != "" {
+		messages = append(messages, &queue.Message{
+			ID:      uuid.NewString(),
+			Type:    CallbackType,
+			Payload: map[string]any{"url": b.CallbackURL, "batch": b.Summary()},
+		})
+	}
+
+	now := time.Now().UTC()
+	for _, msg := range messages {
+		msg.Version = "1"
+		msg.Timestamp = now
+		if err := models.InsertJob(tx, models.NewJob(msg.ID, msg.Type, "")); err != nil {
+			return fmt.Errorf("inserting completion job: %w", err)
+		}
+	}
+	if err := outbox.EnqueueMany(tx, messages, 0); err != nil {
+		return err
+	}
+
+	parent := new(models.Job)
+	err := tx.ModelContext(ctx, parent).Where("job_id = ?", b.BatchID).For("UPDATE").Select()
+	if err != nil {
+		return fmt.Errorf("reading batch job: %w", err)
+	}
+	if models.IsTerminal(parent.Status) {
+		return nil
+	}
+
+	status := models.JobStatusSucceeded
+	if b.Failed > 0 {
+		status = models.JobStatusFailed
+		parent.LastError = fmt.Sprintf("%d of %d children failed", b.Failed, b.Total)
+	}
+	if err := models.Transition(parent, status); err != nil {
+		return err
+	}
+	return models.UpdateJob(tx, parent)
+}
@@ -0,0 +1,163 @@
+package batch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/serdarozerr/request-reply/internal/models"
+	"github.com/serdarozerr/request-reply/internal/service/encryption"
+	"github.com/serdarozerr/request-reply/internal/service/outbox"
+	"github.com/serdarozerr/request-reply/internal/service/queue"
+)
+
+const (
+	// job type of the parent job of a submitted batch
+	JobType = "batch"
+
+	maxItems = 10000
+	// children are inserted and enqueued in chunks of this size
+	chunkSize = 1000
+)
+
+var ErrInvalidBatch = errors.New("invalid batch")
+
+// Request fans out into one child message of Type per item
+type Request struct {
+	Type  string           `json:"type"`
+	Items []map[string]any `json:"items"`
+	// item fields encrypted until the handler runs
+	Sensitive []string `json:"sensitive"`
+	// optional, enqueued once every child is done with
+	// the batch summary added to the payload
+	OnComplete *struct {
+		Type    string         `json:"type"`
+		Payload map[string]any `json:"payload"`
+	} `json:"on_complete"`
+	// optional, the summary is posted here once every child is done
+	CallbackURL string `json:"callback_url"`
+	// optional, children still queued at this time
+	// are dead lettered instead of processed
+	ExpiresAt *time.Time `json:"expires_at"`
+	// optional, lane of the children, bulk work
+	// goes to the low lane when empty
+	Priority string `json:"priority"`
+}
+
+func (r *Request) Validate() error {
+	if r.Type == "" {
+		return fmt.Errorf("%w: type is required", ErrInvalidBatch)
+	}
+	if len(r.Items) == 0 || len(r.Items) > maxItems {
+		return fmt.Errorf("%w: a batch has 1 to %d items", ErrInvalidBatch, maxItems)
+	}
+	if r.OnComplete != nil && r.OnComplete.Type == "" {
+		return fmt.Errorf("%w: on_complete needs a type", ErrInvalidBatch)
+	}
+	if r.ExpiresAt != nil && !r.ExpiresAt.After(time.Now()) {
+		return fmt.Errorf("%w: expires_at must be in the future", ErrInvalidBatch)
+	}
+	if r.CallbackURL != "" {
+		u, err := url.Parse(r.CallbackURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%w: callback_url must be an http or https url", ErrInvalidBatch)
+		}
+		// names are checked again when the consumer dials
+		if internalHost(u.Hostname()) {
+			return fmt.Errorf("%w: callback_url must point to a public host", ErrInvalidBatch)
+		}
+	}
+	return nil
+}
+
+func internalHost(host string) bool {
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	return !ip.IsGlobalUnicast() || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+}
+
+// Submit creates the batch with its children in one transaction, the
+// relay sends the children with SendMessageBatch
+func Submit(ctx context.Context, db *pg.DB, kp encryption.KeyProvider, req *Request, submitter string) (*Batch, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	if len(req.Sensitive) > 0 && kp == nil {
+		return nil, fmt.Errorf("batch has sensitive fields but no key provider is configured")
+	}
+
+	// a batch must not hold up interactive jobs of the same type
+	priority := req.Priority
+	if priority == "" {
+		priority = queue.PriorityLow
+	}
+
+	now := time.Now().UTC()
+	messages := make([]*queue.Message, len(req.Items))
+	for i, item := range req.Items {
+		msg := &queue.Message{
+			Version:   "1",
+			ID:        uuid.NewString(),
+			Type:      req.Type,
+			Payload:   item,
+			Timestamp: now,
+			ExpiresAt: req.ExpiresAt,
+			Priority:  priority,
+		}
+		if len(req.Sensitive) > 0 {
+			var err error
+			msg.Encryption, err = encryption.Seal(ctx, kp, msg.ID, msg.Payload, req.Sensitive)
+			if err != nil {
+				return nil, fmt.Errorf("encrypting item %d: %w", i, err)
+			}
+		}
+		messages[i] = msg
+	}
+
+	b := &Batch{CallbackURL: req.CallbackURL}
+	if req.OnComplete != nil {
+		b.OnComplete = &queue.Message{Type: req.OnComplete.Type, Payload: req.OnComplete.Payload}
+	}
+
+	err := db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		if err := Create(tx, b, JobType, submitter); err != nil {
+			return err
+		}
+
+		for start := 0; start < len(messages); start += chunkSize {
+			chunk := messages[start:min(start+chunkSize, len(messages))]
+
+			jobs := make([]*models.Job, len(chunk))
+			for i, msg := range chunk {
+				jobs[i] = models.NewJob(msg.ID, msg.Type, b.BatchID)
+				jobs[i].Submitter = submitter
+			}
+			if err := models.InsertJobs(tx, jobs); err != nil {
+				return fmt.Errorf("inserting child jobs: %w", err)
+			}
+			if err := outbox.EnqueueMany(tx, chunk, 0); err != nil {
+				return err
+			}
+		}
+
+		return seal(ctx, tx, b.BatchID, len(messages))
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.Total = len(messages)
+	b.Sealed = true
+	return b, nil
+}
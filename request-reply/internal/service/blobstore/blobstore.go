@@ -0,0 +1,18 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore keeps payloads that are too large to travel in a
+// queue message, the local implementation is enough for a single
+// host, an S3 backed one can be plugged in behind the same interface
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	// Get returns ErrNotFound when there is no blob with the key
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+}
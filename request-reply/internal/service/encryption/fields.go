@@ -0,0 +1,140 @@
+package encryption
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Envelope describes how the sensitive fields of a payload were
+// encrypted, it travels with the message next to the payload
+type Envelope struct {
+	KeyID string `json:"key_id"`
+	// data key wrapped with the KeyID master key
+	WrappedKey string   `json:"wrapped_key"`
+	Fields     []string `json:"fields"`
+}
+
+// Seal encrypts the listed payload fields in place with a fresh data
+// key, messageID is bound to the ciphertext so fields can't be moved
+// between messages. It returns nil when none of the fields are present
+func Seal(ctx context.Context, kp KeyProvider, messageID string, payload map[string]any, fields []string) (*Envelope, error) {
+	var present []string
+	for _, f := range fields {
+		if _, ok := payload[f]; ok {
+			present = append(present, f)
+		}
+	}
+	if len(present) == 0 {
+		return nil, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("generating data key: %w", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID := kp.ActiveKeyID()
+	wrapped, err := kp.WrapKey(ctx, keyID, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("wrapping data key: %w", err)
+	}
+
+	for _, f := range present {
+		plaintext, err := json.Marshal(payload[f])
+		if err != nil {
+			return nil, fmt.Errorf("encoding field %s: %w", f, err)
+		}
+		sealed, err := seal(aead, plaintext, fieldAAD(messageID, f))
+		if err != nil {
+			return nil, fmt.Errorf("encrypting field %s: %w", f, err)
+		}
+		payload[f] = base64.StdEncoding.EncodeToString(sealed)
+	}
+
+	return &Envelope{
+		KeyID:      keyID,
+		WrappedKey: base64.StdEncoding.EncodeToString(wrapped),
+		Fields:     present,
+	}, nil
+}
+
+// Open decrypts the fields listed in env in place
+func Open(ctx context.Context, kp KeyProvider, messageID string, payload map[string]any, env *Envelope) error {
+	if env == nil {
+		return nil
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(env.WrappedKey)
+	if err != nil {
+		return fmt.Errorf("decoding data key: %w", err)
+	}
+	dataKey, err := kp.UnwrapKey(ctx, env.KeyID, wrapped)
+	if err != nil {
+		return fmt.Errorf("unwrapping data key: %w", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range env.Fields {
+		encoded, ok := payload[f].(string)
+		if !ok {
+			return fmt.Errorf("encrypted field %s is missing", f)
+		}
+		sealed, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("decoding field %s: %w", f, err)
+		}
+		plaintext, err := open(aead, sealed, fieldAAD(messageID, f))
+		if err != nil {
+			return fmt.Errorf("field %s: %w", f, err)
+		}
+		var v any
+		if err := json.Unmarshal(plaintext, &v); err != nil {
+			return fmt.Errorf("decoding field %s: %w", f, err)
+		}
+		payload[f] = v
+	}
+	return nil
+}
+
+func fieldAAD(messageID, field string) []byte {
+	return []byte(messageID + "/" + field)
+}
+
+// TaggedFields returns the payload names of the struct fields tagged
+// with `sensitive:"true"`, the json tag name or the lower cased
+// field name when there is none
+func TaggedFields(v any) []string {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var fields []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("sensitive") != "true" {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields = append(fields, name)
+	}
+	return fields
+}
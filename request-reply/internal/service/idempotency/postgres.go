@@ -0,0 +1,117 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	m "github.com/serdarozerr/request-reply/pkg/middleware"
+)
+
+type record struct {
+	tableName struct{} `pg:"idempotency_keys"`
+
+	Owner          string      `pg:"owner,pk,use_zero"`
+	Key            string      `pg:"key,pk"`
+	Fingerprint    string      `pg:"fingerprint"`
+	Completed      bool        `pg:"completed,use_zero"`
+	StatusCode     int         `pg:"status_code"`
+	ResponseHeader http.Header `pg:"response_header,type:jsonb"`
+	ResponseBody   []byte      `pg:"response_body,type:bytea"`
+	CreatedAt      time.Time   `pg:"created_at"`
+	ExpiresAt      time.Time   `pg:"expires_at"`
+	LockedUntil    time.Time   `pg:"locked_until"`
+}
+
+// PostgresStore keeps idempotency keys in the idempotency_keys
+// table, it implements middleware.IdempotencyStore
+type PostgresStore struct {
+	db *pg.DB
+}
+
+func NewPostgresStore(db *pg.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Reserve(ctx context.Context, owner, key, fingerprint string, lock, ttl time.Duration) (*m.IdempotencyRecord, error) {
+	var reserved string
+
+	// an expired key is taken over like a new one, an in progress one
+	// once its lock ran out, the request holding it crashed or took
+	// longer than the lock. The lock is not renewed
+	_, err := s.db.QueryOneContext(ctx, pg.Scan(&reserved), `
+		INSERT INTO idempotency_keys (owner, key, fingerprint, completed, created_at, expires_at, locked_until)
+		VALUES (?4, ?0, ?1, FALSE, now(), now() + ?2 * interval '1 millisecond', now() + ?3 * interval '1 millisecond')
+		ON CONFLICT (owner, key) DO UPDATE
+		SET fingerprint = EXCLUDED.fingerprint,
+			completed = FALSE,
+			status_code = NULL,
+			response_header = NULL,
+			response_body = NULL,
+			created_at = EXCLUDED.created_at,
+			expires_at = EXCLUDED.expires_at,
+			locked_until = EXCLUDED.locked_until
+		WHERE idempotency_keys.expires_at < now()
+			OR (NOT idempotency_keys.completed
+				AND idempotency_keys.locked_until < now()
+				AND idempotency_keys.fingerprint = EXCLUDED.fingerprint)
+		RETURNING key`,
+		key, fingerprint, ttl.Milliseconds(), lock.Milliseconds(), owner)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, pg.ErrNoRows) {
+		return nil, fmt.Errorf("reserving idempotency key: %w", err)
+	}
+
+	rec := new(record)
+	if err := s.db.ModelContext(ctx, rec).Where("owner = ?", owner).Where("key = ?", key).Select(); err != nil {
+		return nil, fmt.Errorf("reading idempotency key: %w", err)
+	}
+
+	return &m.IdempotencyRecord{
+		Fingerprint: rec.Fingerprint,
+		Completed:   rec.Completed,
+		StatusCode:  rec.StatusCode,
+		Header:      rec.ResponseHeader,
+		Body:        rec.ResponseBody,
+	}, nil
+}
+
+func (s *PostgresStore) Save(ctx context.Context, owner, key string, rec *m.IdempotencyRecord) error {
+	_, err := s.db.ModelContext(ctx, &record{
+		Owner:          owner,
+		Key:            key,
+		Completed:      rec.Completed,
+		StatusCode:     rec.StatusCode,
+		ResponseHeader: rec.Header,
+		ResponseBody:   rec.Body,
+	}).
+		Column("completed", "status_code", "response_header", "response_body").
+		WherePK().
+		Update()
+	if err != nil {
+		return fmt.Errorf("saving idempotency key: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) Delete(ctx context.Context, owner, key string) error {
+	_, err := s.db.ModelContext(ctx, (*record)(nil)).Where("owner = ?", owner).Where("key = ?", key).Delete()
+	if err != nil {
+		return fmt.Errorf("deleting idempotency key: %w", err)
+	}
+	return nil
+}
+
+// Purge deletes expired keys
+func (s *PostgresStore) Purge(ctx context.Context) (int, error) {
+	res, err := s.db.ModelContext(ctx, (*record)(nil)).Where("expires_at < now()").Delete()
+	if err != nil {
+		return 0, fmt.Errorf("purging idempotency keys: %w", err)
+	}
+	return res.RowsAffected(), nil
+}
@@ -0,0 +1,33 @@
+package inbox
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	StatusProcessing = "processing"
+	StatusCompleted  = "completed"
+)
+
+var (
+	// the message was already processed, it can be deleted
+	ErrAlreadyCompleted = errors.New("message already completed")
+	// another worker holds an unexpired lease on the message
+	ErrLeased = errors.New("message is leased by another worker")
+)
+
+// Store records which messages are being or have been processed,
+// so redelivered copies of a message are not handled twice
+type Store interface {
+	// Claim takes a lease on the message for owner, it fails with
+	// ErrAlreadyCompleted or ErrLeased when it shouldn't be processed
+	Claim(ctx context.Context, messageID, owner string, lease time.Duration) error
+	// Complete marks the message as processed
+	Complete(ctx context.Context, messageID, owner string) error
+	// Release gives up the lease so a redelivery can claim it again
+	Release(ctx context.Context, messageID, owner string) error
+	// Purge deletes completed entries older than the given time
+	Purge(ctx context.Context, before time.Time) (int, error)
+}
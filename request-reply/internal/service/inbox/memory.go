@@ -0,0 +1,79 @@
+package inbox
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	status      string
+	owner       string
+	leaseUntil  time.Time
+	completedAt time.Time
+}
+
+// MemoryStore keeps the inbox in process memory, it only
+// deduplicates messages handled by the same process
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]*memoryEntry)}
+}
+
+func (s *MemoryStore) Claim(ctx context.Context, messageID, owner string, lease time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	e, ok := s.entries[messageID]
+	if ok {
+		if e.status == StatusCompleted {
+			return ErrAlreadyCompleted
+		}
+		if e.leaseUntil.After(now) && e.owner != owner {
+			return ErrLeased
+		}
+	}
+
+	s.entries[messageID] = &memoryEntry{status: StatusProcessing, owner: owner, leaseUntil: now.Add(lease)}
+	return nil
+}
+
+func (s *MemoryStore) Complete(ctx context.Context, messageID, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[messageID]; ok && e.owner == owner {
+		e.status = StatusCompleted
+		e.completedAt = time.Now()
+	}
+	return nil
+}
+
+func (s *MemoryStore) Release(ctx context.Context, messageID, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[messageID]; ok && e.owner == owner && e.status == StatusProcessing {
+		delete(s.entries, messageID)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Purge(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for id, e := range s.entries {
+		if e.status == StatusCompleted && e.completedAt.Before(before) {
+			delete(s.entries, id)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,108 @@
+package inbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCompletedMessageIsNotClaimedAgain(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+
+	if err := s.Claim(ctx, "m1", "worker-1", time.Minute); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	if err := s.Complete(ctx, "m1", "worker-1"); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+
+	for _, owner := range []string{"worker-1", "worker-2"} {
+		if err := s.Claim(ctx, "m1", owner, time.Minute); !errors.Is(err, ErrAlreadyCompleted) {
+			t.Fatalf("claim by %s after complete = %v, want ErrAlreadyCompleted", owner, err)
+		}
+	}
+}
+
+func TestLeaseBlocksOtherOwnersUntilItExpires(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+
+	if err := s.Claim(ctx, "m1", "worker-1", 50*time.Millisecond); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	if err := s.Claim(ctx, "m1", "worker-2", time.Minute); !errors.Is(err, ErrLeased) {
+		t.Fatalf("claim by other owner = %v, want ErrLeased", err)
+	}
+	// the holder of the lease may claim again, e.g. after a redelivery
+	if err := s.Claim(ctx, "m1", "worker-1", 50*time.Millisecond); err != nil {
+		t.Fatalf("reclaim by owner: %v", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := s.Claim(ctx, "m1", "worker-2", time.Minute); err != nil {
+		t.Fatalf("claim after lease expired: %v", err)
+	}
+	// the first worker lost the lease, it can't complete the message
+	if err := s.Complete(ctx, "m1", "worker-1"); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+	if err := s.Claim(ctx, "m1", "worker-1", time.Minute); !errors.Is(err, ErrLeased) {
+		t.Fatalf("claim after stale complete = %v, want ErrLeased", err)
+	}
+}
+
+func TestReleaseLetsRedeliveryBeClaimed(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+
+	if err := s.Claim(ctx, "m1", "worker-1", time.Minute); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	// only the owner's release counts
+	if err := s.Release(ctx, "m1", "worker-2"); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if err := s.Claim(ctx, "m1", "worker-2", time.Minute); !errors.Is(err, ErrLeased) {
+		t.Fatalf("claim after foreign release = %v, want ErrLeased", err)
+	}
+
+	if err := s.Release(ctx, "m1", "worker-1"); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if err := s.Claim(ctx, "m1", "worker-2", time.Minute); err != nil {
+		t.Fatalf("claim after release: %v", err)
+	}
+}
+
+func TestPurgeDropsOnlyOldCompletedEntries(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+
+	for _, id := range []string{"done", "processing"} {
+		if err := s.Claim(ctx, id, "worker-1", time.Minute); err != nil {
+			t.Fatalf("claim %s: %v", id, err)
+		}
+	}
+	if err := s.Complete(ctx, "done", "worker-1"); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+
+	n, err := s.Purge(ctx, time.Now().Add(-time.Hour))
+	if err != nil || n != 0 {
+		t.Fatalf("purge of recent entries = %d, %v, want 0", n, err)
+	}
+
+	n, err = s.Purge(ctx, time.Now().Add(time.Second))
+	if err != nil || n != 1 {
+		t.Fatalf("purge = %d, %v, want 1", n, err)
+	}
+	// a purged message is forgotten, a very late redelivery is processed again
+	if err := s.Claim(ctx, "done", "worker-2", time.Minute); err != nil {
+		t.Fatalf("claim after purge: %v", err)
+	}
+	if err := s.Claim(ctx, "processing", "worker-2", time.Minute); !errors.Is(err, ErrLeased) {
+		t.Fatalf("in-flight entry was purged, claim = %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package inbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+// PostgresStore keeps the inbox in the inbox table, so duplicates
+// are detected across every consumer sharing the database
+type PostgresStore struct {
+	db *pg.DB
+}
+
+func NewPostgresStore(db *pg.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Claim(ctx context.Context, messageID, owner string, lease time.Duration) error {
+	var claimed string
+
+	// a new message is inserted, an existing one is taken over
+	// only when it isn't completed and its lease has expired
+	_, err := s.db.QueryOneContext(ctx, pg.Scan(&claimed), `
+		INSERT INTO inbox (message_id, status, owner, lease_until, attempts, created_at)
+		VALUES (?0, ?1, ?2, now() + ?3 * interval '1 millisecond', 1, now())
+		ON CONFLICT (message_id) DO UPDATE
+		SET owner = EXCLUDED.owner,
+			lease_until = EXCLUDED.lease_until,
+			attempts = inbox.attempts + 1
+		WHERE inbox.status <> ?4 AND (inbox.lease_until < now() OR inbox.owner = EXCLUDED.owner)
+		RETURNING message_id`,
+		messageID, StatusProcessing, owner, lease.Milliseconds(), StatusCompleted)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, pg.ErrNoRows) {
+		return fmt.Errorf("claiming inbox message: %w", err)
+	}
+
+	var status string
+	_, err = s.db.QueryOneContext(ctx, pg.Scan(&status), `SELECT status FROM inbox WHERE message_id = ?`, messageID)
+	if err != nil {
+		return fmt.Errorf("reading inbox message: %w", err)
+	}
+	if status == StatusCompleted {
+		return ErrAlreadyCompleted
+	}
+	return ErrLeased
+}
+
+func (s *PostgresStore) Complete(ctx context.Context, messageID, owner string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE inbox SET status = ?, completed_at = now(), lease_until = NULL
+		WHERE message_id = ? AND owner = ?`,
+		StatusCompleted, messageID, owner)
+	if err != nil {
+		return fmt.Errorf("completing inbox message: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) Release(ctx context.Context, messageID, owner string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE inbox SET lease_until = now()
+		WHERE message_id = ? AND owner = ? AND status = ?`,
+		messageID, owner, StatusProcessing)
+	if err != nil {
+		return fmt.Errorf("releasing inbox message: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) Purge(ctx context.Context, before time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx, `
+		DELETE FROM inbox WHERE status = ? AND completed_at < ?`,
+		StatusCompleted, before)
+	if err != nil {
+		return 0, fmt.Errorf("purging inbox: %w", err)
+	}
+	return res.RowsAffected(), nil
+}
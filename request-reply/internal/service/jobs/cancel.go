@@ -0,0 +1,109 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/serdarozerr/request-reply/internal/models"
+	"github.com/serdarozerr/request-reply/internal/service/batch"
+	"github.com/serdarozerr/request-reply/internal/service/workflow"
+)
+
+// running workers are told about cancelled jobs on this channel,
+// the payload is the job id
+const cancelChannel = "job_cancelled"
+
+// Cancel moves the job and its unfinished child jobs to cancelled.
+// Queued jobs are dropped by the consumer on receipt, workers running
+// one are notified to cancel the handler. It returns the job and the
+// number of cancelled children, ErrInvalidTransition when the job
+// is already finished
+func Cancel(ctx context.Context, db *pg.DB, jobID string) (*models.Job, int, error) {
+	var (
+		job      *models.Job
+		children int
+	)
+
+	err := db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		job = new(models.Job)
+		err := tx.ModelContext(ctx, job).Where("job_id = ?", jobID).For("UPDATE").Select()
+		if err != nil {
+			return err
+		}
+
+		inFlight := job.Status == models.JobStatusReceived || job.Status == models.JobStatusRunning
+		if err := models.Transition(job, models.JobStatusCancelled); err != nil {
+			return err
+		}
+		if err := models.UpdateJob(tx, job); err != nil {
+			return fmt.Errorf("updating job: %w", err)
+		}
+		if inFlight {
+			if err := notifyCancel(ctx, tx, job.JobID); err != nil {
+				return err
+			}
+		}
+
+		if err := batch.ChildFinished(ctx, tx, job); err != nil {
+			return err
+		}
+		if err := workflow.StepFinished(ctx, tx, job, nil); err != nil {
+			return err
+		}
+
+		running, n, err := models.CancelChildJobs(tx, job.JobID)
+		if err != nil {
+			return fmt.Errorf("cancelling child jobs: %w", err)
+		}
+		children = n
+
+		if err := batch.ChildrenCancelled(ctx, tx, job.JobID, n); err != nil {
+			return err
+		}
+
+		for _, id := range running {
+			if err := notifyCancel(ctx, tx, id); err != nil {
+				return err
+			}
+		}
+
+		// steps of a cancelled workflow that didn't start are skipped
+		return workflow.Cancelled(ctx, tx, job.JobID)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return job, children, nil
+}
+
+// notifications are delivered when the transaction commits
+func notifyCancel(ctx context.Context, tx *pg.Tx, jobID string) error {
+	if _, err := tx.ExecContext(ctx, "SELECT pg_notify(?, ?)", cancelChannel, jobID); err != nil {
+		return fmt.Errorf("notifying cancel of job %s: %w", jobID, err)
+	}
+	return nil
+}
+
+// ListenCancellations calls cancel with the id of every job cancelled
+// while it runs, until ctx is done. Pass Consumer.Cancel
+func ListenCancellations(ctx context.Context, db *pg.DB, cancel func(jobID string) bool) {
+	ln := db.Listen(ctx, cancelChannel)
+	defer ln.Close()
+
+	ch := ln.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n, ok := <-ch:
+			if !ok {
+				return
+			}
+			if cancel(n.Payload) {
+				slog.Info("cancelling running job", "job_id", n.Payload)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/serdarozerr/request-reply/internal/models"
+	"github.com/serdarozerr/request-reply/internal/service/batch"
+	"github.com/serdarozerr/request-reply/internal/service/workflow"
+)
+
+// Fail moves a job whose message will never be processed to
+// failed, the parent batch or workflow is told in the same
+// transaction. Unknown and finished jobs are left alone
+func Fail(ctx context.Context, tx *pg.Tx, jobID, reason string) error {
+	job := new(models.Job)
+	err := tx.ModelContext(ctx, job).Where("job_id = ?", jobID).For("UPDATE").Select()
+	if errors.Is(err, pg.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading job: %w", err)
+	}
+
+	if models.IsTerminal(job.Status) {
+		return nil
+	}
+
+	// a retrying job reaches failed only through received
+	if !models.CanTransition(job.Status, models.JobStatusFailed) {
+		if err := models.Transition(job, models.JobStatusReceived); err != nil {
+			return err
+		}
+	}
+	if err := models.Transition(job, models.JobStatusFailed); err != nil {
+		return err
+	}
+	job.LastError = reason
+	if err := models.UpdateJob(tx, job); err != nil {
+		return fmt.Errorf("updating job: %w", err)
+	}
+
+	if job.ParentID == "" {
+		return nil
+	}
+	if err := batch.ChildFinished(ctx, tx, job); err != nil {
+		return err
+	}
+	return workflow.StepFinished(ctx, tx, job, nil)
+}
@@ -0,0 +1,169 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/google/uuid"
+	"github.com/serdarozerr/request-reply/internal/models"
+	"github.com/serdarozerr/request-reply/internal/service/blobstore"
+	"github.com/serdarozerr/request-reply/internal/service/queue"
+)
+
+const (
+	defaultInlineResultBytes = 64 * 1024
+	defaultResultRetention   = 7 * 24 * time.Hour
+)
+
+var (
+	ErrNoResult      = errors.New("job has no result")
+	ErrResultExpired = errors.New("job result has expired")
+)
+
+// ResultStore keeps job results, small results inline in the
+// job_results table and the others in the blob store
+type ResultStore struct {
+	db    *pg.DB
+	blobs blobstore.BlobStore
+	// results up to this size are stored inline
+	inlineMaxBytes int
+	// results are deleted this long after they are stored
+	retention time.Duration
+}
+
+// NewResultStore returns a result store, blobs is optional
+// when every result fits inline
+func NewResultStore(db *pg.DB, blobs blobstore.BlobStore, inlineMaxBytes int, retention time.Duration) *ResultStore {
+	if inlineMaxBytes <= 0 {
+		inlineMaxBytes = defaultInlineResultBytes
+	}
+	if retention <= 0 {
+		retention = defaultResultRetention
+	}
+	return &ResultStore{db: db, blobs: blobs, inlineMaxBytes: inlineMaxBytes, retention: retention}
+}
+
+// every attempt uploads under its own key, discarding the blob of
+// an attempt that wasn't saved can't touch a saved one
+func resultKey(jobID string) string {
+	return "results/" + jobID + "/" + uuid.NewString()
+}
+
+// prepare uploads a result that doesn't fit inline and returns the
+// row to save, it is called before the job's transaction starts.
+// Pass the row to discard when the transaction doesn't save it
+func (s *ResultStore) prepare(ctx context.Context, jobID string, res *queue.Result) (*models.JobResult, error) {
+	contentType := res.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	now := time.Now().UTC()
+	row := &models.JobResult{
+		JobID:       jobID,
+		ContentType: contentType,
+		SizeBytes:   int64(len(res.Data)),
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(s.retention),
+	}
+
+	if len(res.Data) <= s.inlineMaxBytes {
+		row.Inline = res.Data
+		if row.Inline == nil {
+			row.Inline = []byte{}
+		}
+		return row, nil
+	}
+
+	if s.blobs == nil {
+		return nil, fmt.Errorf("result of job %s can't be stored inline and no blob store is configured", jobID)
+	}
+	row.BlobRef = resultKey(jobID)
+	if err := s.blobs.Put(ctx, row.BlobRef, res.Data); err != nil {
+		return nil, fmt.Errorf("storing result of job %s: %w", jobID, err)
+	}
+	return row, nil
+}
+
+// discard deletes the blob of a prepared row that wasn't saved
+func (s *ResultStore) discard(ctx context.Context, row *models.JobResult) {
+	if row == nil || row.BlobRef == "" {
+		return
+	}
+	if err := s.blobs.Delete(ctx, row.BlobRef); err != nil {
+		slog.Error("deleting unsaved result blob", "job_id", row.JobID, "ref", row.BlobRef, "error", err)
+	}
+}
+
+func (s *ResultStore) save(db orm.DB, row *models.JobResult) error {
+	if err := models.SaveJobResult(db, row); err != nil {
+		return fmt.Errorf("saving result of job %s: %w", row.JobID, err)
+	}
+	return nil
+}
+
+// Get returns the result of the job with its data, ErrNoResult when
+// the job has none and ErrResultExpired once the retention passed
+func (s *ResultStore) Get(ctx context.Context, jobID string) (*models.JobResult, []byte, error) {
+	row, err := models.GetJobResult(s.db.WithContext(ctx), jobID)
+	if errors.Is(err, pg.ErrNoRows) {
+		return nil, nil, ErrNoResult
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading result: %w", err)
+	}
+	if !row.PurgedAt.IsZero() || time.Now().After(row.ExpiresAt) {
+		return row, nil, ErrResultExpired
+	}
+
+	if row.BlobRef == "" {
+		return row, row.Inline, nil
+	}
+	if s.blobs == nil {
+		return nil, nil, fmt.Errorf("result of job %s is in the blob store but none is configured", jobID)
+	}
+	data, err := s.blobs.Get(ctx, row.BlobRef)
+	if errors.Is(err, blobstore.ErrNotFound) {
+		return row, nil, ErrResultExpired
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading result of job %s: %w", jobID, err)
+	}
+	return row, data, nil
+}
+
+// Purge deletes the data of expired results and their blobs
+func (s *ResultStore) Purge(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		expired, err := models.ListExpiredJobResults(s.db.WithContext(ctx), time.Now().UTC(), 500)
+		if err != nil {
+			return total, fmt.Errorf("listing expired results: %w", err)
+		}
+		if len(expired) == 0 {
+			return total, nil
+		}
+
+		ids := make([]string, len(expired))
+		for i, r := range expired {
+			ids[i] = r.JobID
+			if r.BlobRef == "" || s.blobs == nil {
+				continue
+			}
+			if err := s.blobs.Delete(ctx, r.BlobRef); err != nil {
+				slog.Error("deleting result blob", "job_id", r.JobID, "ref", r.BlobRef, "error", err)
+			}
+		}
+
+		n, err := models.PurgeJobResults(s.db.WithContext(ctx), ids)
+		if err != nil {
+			return total, fmt.Errorf("deleting expired results: %w", err)
+		}
+		total += n
+	}
+}
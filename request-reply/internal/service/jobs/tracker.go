@@ -0,0 +1,172 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/serdarozerr/request-reply/internal/models"
+	"github.com/serdarozerr/request-reply/internal/service/batch"
+	"github.com/serdarozerr/request-reply/internal/service/queue"
+	"github.com/serdarozerr/request-reply/internal/service/workflow"
+)
+
+// Tracker keeps the jobs table and the attempt history up to date,
+// it implements queue.JobTracker
+type Tracker struct {
+	db *pg.DB
+	// receive count at which a transient failure marks the job dead,
+	// match it with maxReceiveCount of the queue's redrive policy
+	maxReceiveCount int
+	// optional, where the results of succeeded jobs are kept
+	results *ResultStore
+}
+
+func NewTracker(db *pg.DB, maxReceiveCount int, results *ResultStore) *Tracker {
+	return &Tracker{db: db, maxReceiveCount: maxReceiveCount, results: results}
+}
+
+func (t *Tracker) Start(ctx context.Context, msg *queue.MessageConsumer, workerID string) (int, error) {
+	var attempt int
+
+	err := t.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		job := new(models.Job)
+		err := tx.ModelContext(ctx, job).Where("job_id = ?", msg.ID).For("UPDATE").Select()
+		if errors.Is(err, pg.ErrNoRows) {
+			// messages sent without a job row are tracked from here on
+			job = models.NewJob(msg.ID, msg.Type, "")
+			if err := models.InsertJob(tx, job); err != nil {
+				return fmt.Errorf("inserting job: %w", err)
+			}
+		} else if err != nil {
+			return fmt.Errorf("reading job: %w", err)
+		}
+
+		if models.IsTerminal(job.Status) {
+			return queue.ErrJobFinished
+		}
+
+		for _, status := range []string{models.JobStatusReceived, models.JobStatusRunning} {
+			if job.Status == status {
+				continue
+			}
+			if err := models.Transition(job, status); err != nil {
+				return err
+			}
+		}
+
+		job.Attempts++
+		job.WorkerID = workerID
+		attempt = job.Attempts
+
+		if err := models.UpdateJob(tx, job); err != nil {
+			return fmt.Errorf("updating job: %w", err)
+		}
+
+		return models.InsertJobAttempt(tx, &models.JobAttempt{
+			JobID:     job.JobID,
+			Attempt:   attempt,
+			WorkerID:  workerID,
+			Status:    models.JobStatusRunning,
+			StartedAt: time.Now().UTC(),
+		})
+	})
+
+	return attempt, err
+}
+
+func (t *Tracker) Finish(ctx context.Context, msg *queue.MessageConsumer, workerID string, attempt int, result *queue.Result, handlerErr error) error {
+	status, errMsg := t.outcome(msg, handlerErr)
+
+	var row *models.JobResult
+	if status == models.JobStatusSucceeded && result != nil && t.results != nil {
+		var err error
+		if row, err = t.results.prepare(ctx, msg.ID, result); err != nil {
+			return err
+		}
+	}
+
+	saved := false
+	err := t.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		job := new(models.Job)
+		err := tx.ModelContext(ctx, job).Where("job_id = ?", msg.ID).For("UPDATE").Select()
+		if err != nil {
+			return fmt.Errorf("reading job: %w", err)
+		}
+
+		if err := models.FinishJobAttempt(tx, job.JobID, attempt, status, errMsg); err != nil {
+			return fmt.Errorf("finishing attempt: %w", err)
+		}
+
+		// the job may have been cancelled while the handler ran,
+		// the attempt is recorded but the status stays
+		if job.Status != models.JobStatusRunning {
+			return nil
+		}
+
+		if err := models.Transition(job, status); err != nil {
+			return err
+		}
+		job.LastError = errMsg
+		if err := models.UpdateJob(tx, job); err != nil {
+			return err
+		}
+
+		if row != nil {
+			if err := t.results.save(tx, row); err != nil {
+				return err
+			}
+			saved = true
+		}
+
+		if !models.IsTerminal(job.Status) || job.ParentID == "" {
+			return nil
+		}
+		if err := batch.ChildFinished(ctx, tx, job); err != nil {
+			return err
+		}
+		// the next steps of a workflow are enqueued
+		// together with the finished one
+		return workflow.StepFinished(ctx, tx, job, result)
+	})
+
+	// the job was cancelled meanwhile or the transaction failed
+	if err != nil || !saved {
+		t.results.discard(ctx, row)
+	}
+	return err
+}
+
+// Quarantined fails the job of a message that was quarantined,
+// it implements queue.QuarantineTracker
+func (t *Tracker) Quarantined(ctx context.Context, jobID string, cause error) error {
+	return t.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		return Fail(ctx, tx, jobID, "message quarantined: "+cause.Error())
+	})
+}
+
+func (t *Tracker) outcome(msg *queue.MessageConsumer, err error) (string, string) {
+	switch {
+	case err == nil:
+		return models.JobStatusSucceeded, ""
+	case errors.Is(err, queue.ErrJobCancelled):
+		return models.JobStatusCancelled, err.Error()
+	case errors.Is(err, queue.ErrMessageExpired):
+		return models.JobStatusDead, err.Error()
+	case queue.IsPermanent(err):
+		return models.JobStatusFailed, err.Error()
+	case t.maxReceiveCount > 0 && receiveCount(msg) >= t.maxReceiveCount:
+		// SQS moves the message to the dead letter queue next
+		return models.JobStatusDead, err.Error()
+	default:
+		return models.JobStatusRetrying, err.Error()
+	}
+}
+
+func receiveCount(msg *queue.MessageConsumer) int {
+	n, _ := strconv.Atoi(msg.Attributes["ApproximateReceiveCount"])
+	return n
+}
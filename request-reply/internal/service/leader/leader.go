@@ -0,0 +1,264 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+)
+
+// ErrNotLeader is returned by Check when the lease in the
+// context was taken over by another instance
+var ErrNotLeader = errors.New("lease is no longer held")
+
+// Lease is a won election, Token grows every time the lease
+// changes hands so writes of a stale leader can be fenced off
+type Lease struct {
+	Name   string
+	Holder string
+	Token  int64
+}
+
+type Config struct {
+	// name of the duty, one leader is elected per name
+	Name string
+	// defaults to hostname-pid
+	ID string
+	// the lease expires this long after the last renewal
+	LeaseTTL time.Duration
+	// how often the leader renews the lease, well below LeaseTTL
+	RenewInterval time.Duration
+	// how often followers try to take the lease
+	RetryInterval time.Duration
+	// called when the lease is won, ctx is cancelled when it is
+	// lost or Run stops, the duty should return then. The lease
+	// is released when it returns early
+	OnElected func(ctx context.Context, lease *Lease)
+	// optional, called after OnElected returned
+	OnRevoked func(lease *Lease)
+}
+
+// Elector campaigns for a lease in the leader_leases table and runs
+// OnElected while holding it, leases are renewed with heartbeats and
+// time out when the leader dies
+type Elector struct {
+	db  *pg.DB
+	cfg Config
+
+	mu    sync.RWMutex
+	lease *Lease
+}
+
+func New(db *pg.DB, cfg Config) *Elector {
+
+	if cfg.ID == "" {
+		hostname, _ := os.Hostname()
+		cfg.ID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+
+	if cfg.LeaseTTL <= 0 {
+		cfg.LeaseTTL = 15 * time.Second
+	}
+
+	if cfg.RenewInterval <= 0 || cfg.RenewInterval >= cfg.LeaseTTL {
+		cfg.RenewInterval = cfg.LeaseTTL / 3
+	}
+
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = cfg.LeaseTTL / 3
+	}
+
+	return &Elector{db: db, cfg: cfg}
+}
+
+// Lease returns the held lease, nil when this instance is a follower
+func (e *Elector) Lease() *Lease {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.lease
+}
+
+func (e *Elector) IsLeader() bool {
+	return e.Lease() != nil
+}
+
+func (e *Elector) setLease(l *Lease) {
+	e.mu.Lock()
+	e.lease = l
+	e.mu.Unlock()
+}
+
+// Run campaigns until ctx is done
+func (e *Elector) Run(ctx context.Context) error {
+	for {
+		lease, err := e.acquire(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("acquiring lease", "name", e.cfg.Name, "error", err)
+		}
+
+		if lease != nil {
+			e.lead(ctx, lease)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(e.cfg.RetryInterval):
+		}
+	}
+}
+
+// lead runs the duty and renews the lease until one of them stops
+func (e *Elector) lead(ctx context.Context, lease *Lease) {
+	slog.Info("elected leader", "name", lease.Name, "holder", lease.Holder, "token", lease.Token)
+	e.setLease(lease)
+
+	dutyCtx, stop := context.WithCancel(WithLease(ctx, lease))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if e.cfg.OnElected != nil {
+			e.cfg.OnElected(dutyCtx, lease)
+		}
+	}()
+
+	// the lease is only trusted until it would have
+	// expired after the last successful renewal
+	validUntil := time.Now().Add(e.cfg.LeaseTTL)
+	ticker := time.NewTicker(e.cfg.RenewInterval)
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-done:
+			break loop
+		case <-ticker.C:
+			renewedAt := time.Now()
+			err := e.renew(ctx, lease)
+			if errors.Is(err, ErrNotLeader) {
+				slog.Warn("lease was taken over", "name", lease.Name, "token", lease.Token)
+				break loop
+			}
+			if err != nil {
+				slog.Error("renewing lease", "name", lease.Name, "error", err)
+				// step down before another instance may take over
+				if time.Until(validUntil) < e.cfg.RenewInterval {
+					break loop
+				}
+				continue
+			}
+			validUntil = renewedAt.Add(e.cfg.LeaseTTL)
+		}
+	}
+
+	ticker.Stop()
+	stop()
+	<-done
+	e.setLease(nil)
+
+	// let a follower take over right away
+	releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.release(releaseCtx, lease); err != nil {
+		slog.Error("releasing lease", "name", lease.Name, "error", err)
+	}
+
+	slog.Info("lost leadership", "name", lease.Name, "token", lease.Token)
+	if e.cfg.OnRevoked != nil {
+		e.cfg.OnRevoked(lease)
+	}
+}
+
+// acquire takes the lease when it is free or expired, returns
+// nil without an error when another instance holds it
+func (e *Elector) acquire(ctx context.Context) (*Lease, error) {
+	var token int64
+	_, err := e.db.QueryOneContext(ctx, pg.Scan(&token), `
+		INSERT INTO leader_leases (name, holder, token, acquired_at, renewed_at, expires_at)
+		VALUES (?0, ?1, 1, now(), now(), now() + ?2 * interval '1 millisecond')
+		ON CONFLICT (name) DO UPDATE
+		SET holder = EXCLUDED.holder,
+			token = leader_leases.token + 1,
+			acquired_at = EXCLUDED.acquired_at,
+			renewed_at = EXCLUDED.renewed_at,
+			expires_at = EXCLUDED.expires_at
+		WHERE leader_leases.expires_at < now()
+		RETURNING token`,
+		e.cfg.Name, e.cfg.ID, e.cfg.LeaseTTL.Milliseconds())
+	if errors.Is(err, pg.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Lease{Name: e.cfg.Name, Holder: e.cfg.ID, Token: token}, nil
+}
+
+func (e *Elector) renew(ctx context.Context, lease *Lease) error {
+	res, err := e.db.ExecContext(ctx, `
+		UPDATE leader_leases
+		SET renewed_at = now(), expires_at = now() + ?3 * interval '1 millisecond'
+		WHERE name = ?0 AND holder = ?1 AND token = ?2 AND expires_at > now()`,
+		lease.Name, lease.Holder, lease.Token, e.cfg.LeaseTTL.Milliseconds())
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return ErrNotLeader
+	}
+	return nil
+}
+
+func (e *Elector) release(ctx context.Context, lease *Lease) error {
+	_, err := e.db.ExecContext(ctx, `
+		UPDATE leader_leases SET expires_at = now()
+		WHERE name = ?0 AND holder = ?1 AND token = ?2`,
+		lease.Name, lease.Holder, lease.Token)
+	return err
+}
+
+type leaseKey struct{}
+
+// WithLease returns a context carrying the lease, Check
+// uses it to fence writes
+func WithLease(ctx context.Context, lease *Lease) context.Context {
+	return context.WithValue(ctx, leaseKey{}, lease)
+}
+
+func LeaseFromContext(ctx context.Context) (*Lease, bool) {
+	lease, ok := ctx.Value(leaseKey{}).(*Lease)
+	return lease, ok
+}
+
+// Check fails with ErrNotLeader when the lease in ctx is no longer
+// current. Call it inside the transaction of a singleton duty, the
+// row stays share locked so no other instance can take the lease
+// before the transaction ends. Without a lease in ctx it is a no-op
+func Check(ctx context.Context, db orm.DB) error {
+	lease, ok := LeaseFromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	var token int64
+	_, err := db.QueryOneContext(ctx, pg.Scan(&token), `
+		SELECT token FROM leader_leases
+		WHERE name = ? AND expires_at > now()
+		FOR SHARE`,
+		lease.Name)
+	if errors.Is(err, pg.ErrNoRows) || (err == nil && token != lease.Token) {
+		return fmt.Errorf("%w: %s token %d", ErrNotLeader, lease.Name, lease.Token)
+	}
+	if err != nil {
+		return fmt.Errorf("checking lease: %w", err)
+	}
+	return nil
+}
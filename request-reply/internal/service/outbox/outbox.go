@@ -0,0 +1,59 @@
+package outbox
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/serdarozerr/request-reply/internal/service/queue"
+)
+
+// record is a message waiting to be published, it is written
+// in the same transaction as the job it belongs to
+type record struct {
+	tableName struct{} `pg:"outbox"`
+
+	ID            int64          `pg:"id,pk"`
+	MessageID     string         `pg:"message_id"`
+	Message       *queue.Message `pg:"message,type:jsonb"`
+	DelaySeconds  int            `pg:"delay_seconds,use_zero"`
+	Attempts      int            `pg:"attempts,use_zero"`
+	LastError     string         `pg:"last_error"`
+	NextAttemptAt time.Time      `pg:"next_attempt_at"`
+	CreatedAt     time.Time      `pg:"created_at"`
+	SentAt        time.Time      `pg:"sent_at"`
+	// set when the relay gave up on the row
+	FailedAt time.Time `pg:"failed_at"`
+}
+
+// Enqueue stores the message in the outbox, pass the transaction
+// that writes the job row so both are committed together
+func Enqueue(db orm.DB, m *queue.Message, delaySeconds int) error {
+	return EnqueueMany(db, []*queue.Message{m}, delaySeconds)
+}
+
+func EnqueueMany(db orm.DB, messages []*queue.Message, delaySeconds int) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	records := make([]*record, len(messages))
+	for i, m := range messages {
+		if m.ID == "" {
+			return fmt.Errorf("outbox message %d has no id", i)
+		}
+		records[i] = &record{
+			MessageID:     m.ID,
+			Message:       m,
+			DelaySeconds:  delaySeconds,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}
+	}
+
+	if _, err := db.Model(&records).Insert(); err != nil {
+		return fmt.Errorf("inserting outbox messages: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/serdarozerr/request-reply/internal/service/leader"
+	"github.com/serdarozerr/request-reply/internal/service/queue"
+)
+
+type RelayConfig struct {
+	// rows claimed per poll
+	BatchSize int
+	// wait between polls when the outbox is empty
+	PollInterval time.Duration
+	// first retry delay of a failed row, doubled per attempt
+	RetryBackoff time.Duration
+	// upper limit of the retry delay
+	MaxRetryBackoff time.Duration
+	// sent rows older than this are deleted
+	RetainSent time.Duration
+	// failed sends after which a row is given up on,
+	// it stays in the table with failed_at set
+	MaxAttempts int
+	// optional, called in the relay's transaction with the
+	// message id of a row given up on, pass jobs.Fail
+	OnFail func(ctx context.Context, tx *pg.Tx, messageID, reason string) error
+}
+
+// Relay publishes pending outbox rows to the queue and marks them
+// sent, failed rows are retried with backoff up to MaxAttempts
+type Relay struct {
+	db       *pg.DB
+	producer *queue.Producer
+	batcher  *queue.BatchProducer
+	cfg      RelayConfig
+}
+
+func NewRelay(db *pg.DB, producer *queue.Producer, cfg RelayConfig) *Relay {
+
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = time.Second
+	}
+
+	if cfg.MaxRetryBackoff <= 0 {
+		cfg.MaxRetryBackoff = 5 * time.Minute
+	}
+
+	if cfg.RetainSent <= 0 {
+		cfg.RetainSent = 24 * time.Hour
+	}
+
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 20
+	}
+
+	// a failed row is retried by the relay itself,
+	// the batcher only retries what SQS rejects in a batch
+	batcher := queue.NewBatchProducer(producer, queue.BatchProducerConfig{MaxRetries: 2})
+
+	return &Relay{db: db, producer: producer, batcher: batcher, cfg: cfg}
+}
+
+// Close flushes the messages buffered by the relay
+func (r *Relay) Close(ctx context.Context) error {
+	return r.batcher.Close(ctx)
+}
+
+// Start relays until ctx is done, when ctx carries a leader lease
+// it returns once the lease is lost
+func (r *Relay) Start(ctx context.Context) error {
+	for {
+		n, err := r.relayOnce(ctx)
+		if errors.Is(err, leader.ErrNotLeader) {
+			return err
+		}
+		if err != nil {
+			slog.Error("relaying outbox", "error", err)
+		}
+
+		if err := r.deleteSent(ctx); err != nil {
+			slog.Error("cleaning up outbox", "error", err)
+		}
+
+		// keep draining while full batches come back
+		if err == nil && n == r.cfg.BatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.cfg.PollInterval):
+		}
+	}
+}
+
+// relayOnce claims a batch of due rows, publishes them and
+// records the outcome, returns the number of claimed rows
+func (r *Relay) relayOnce(ctx context.Context) (int, error) {
+	var claimed int
+
+	err := r.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		if err := leader.Check(ctx, tx); err != nil {
+			return err
+		}
+
+		var records []*record
+		err := tx.ModelContext(ctx, &records).
+			Where("sent_at IS NULL").
+			Where("failed_at IS NULL").
+			Where("next_attempt_at <= now()").
+			Order("id").
+			Limit(r.cfg.BatchSize).
+			For("UPDATE SKIP LOCKED").
+			Select()
+		if err != nil {
+			return fmt.Errorf("claiming outbox rows: %w", err)
+		}
+		claimed = len(records)
+		if claimed == 0 {
+			return nil
+		}
+
+		sent, failed := r.publish(ctx, records)
+
+		if len(sent) > 0 {
+			_, err = tx.ModelContext(ctx, (*record)(nil)).
+				Set("sent_at = now()").
+				Where("id IN (?)", pg.In(sent)).
+				Update()
+			if err != nil {
+				return fmt.Errorf("marking outbox rows sent: %w", err)
+			}
+		}
+
+		for _, rec := range failed {
+			rec.Attempts++
+			rec.NextAttemptAt = time.Now().UTC().Add(r.backoff(rec.Attempts))
+			if rec.Attempts >= r.cfg.MaxAttempts {
+				rec.FailedAt = time.Now().UTC()
+			}
+			_, err = tx.ModelContext(ctx, rec).
+				Column("attempts", "last_error", "next_attempt_at", "failed_at").
+				WherePK().
+				Update()
+			if err != nil {
+				return fmt.Errorf("recording outbox failure: %w", err)
+			}
+
+			if rec.FailedAt.IsZero() {
+				slog.Warn("outbox message not sent", "message_id", rec.MessageID, "attempts", rec.Attempts, "error", rec.LastError)
+				continue
+			}
+			slog.Error("giving up on outbox message", "message_id", rec.MessageID, "attempts", rec.Attempts, "error", rec.LastError)
+			if r.cfg.OnFail != nil {
+				reason := fmt.Sprintf("message not delivered after %d attempts: %s", rec.Attempts, rec.LastError)
+				if err := r.cfg.OnFail(ctx, tx, rec.MessageID, reason); err != nil {
+					return fmt.Errorf("failing undelivered message %s: %w", rec.MessageID, err)
+				}
+			}
+		}
+		return nil
+	})
+
+	return claimed, err
+}
+
+// publish sends the records, ones that are already due through
+// the batch producer, and returns the ids of the sent rows and the failed records
+func (r *Relay) publish(ctx context.Context, records []*record) ([]int64, []*record) {
+	var (
+		sent    []int64
+		failed  []*record
+		futures = make(map[*record]*queue.SendFuture)
+	)
+
+	for _, rec := range records {
+		if rec.Message == nil {
+			rec.LastError = "outbox row has no message"
+			failed = append(failed, rec)
+			continue
+		}
+
+		// the delay counts from when the row was written, a row
+		// published late or retried only waits for what is left
+		delay := remainingDelay(rec, time.Now())
+		if delay == 0 {
+			futures[rec] = r.batcher.SendMessage(ctx, rec.Message)
+			continue
+		}
+
+		if _, err := r.producer.SendMessage(ctx, rec.Message, delay); err != nil {
+			rec.LastError = err.Error()
+			failed = append(failed, rec)
+			continue
+		}
+		sent = append(sent, rec.ID)
+	}
+
+	// a row whose wait is cut short by ctx may still go out,
+	// it is sent again later, consumers dedupe by message id
+	for rec, f := range futures {
+		if _, err := f.Wait(ctx); err != nil {
+			rec.LastError = err.Error()
+			failed = append(failed, rec)
+			continue
+		}
+		sent = append(sent, rec.ID)
+	}
+
+	return sent, failed
+}
+
+// remainingDelay returns the seconds until the record is due,
+// rounded up so it is never delivered early
+func remainingDelay(rec *record, now time.Time) int {
+	if rec.DelaySeconds <= 0 {
+		return 0
+	}
+	due := rec.CreatedAt.Add(time.Duration(rec.DelaySeconds) * time.Second)
+	left := due.Sub(now)
+	if left <= 0 {
+		return 0
+	}
+	return int((left + time.Second - 1) / time.Second)
+}
+
+func (r *Relay) backoff(attempts int) time.Duration {
+	d := r.cfg.RetryBackoff
+	for i := 1; i < attempts && d < r.cfg.MaxRetryBackoff; i++ {
+		d *= 2
+	}
+	return min(d, r.cfg.MaxRetryBackoff)
+}
+
+func (r *Relay) deleteSent(ctx context.Context) error {
+	_, err := r.db.ModelContext(ctx, (*record)(nil)).
+		Where("sent_at < ?", time.Now().UTC().Add(-r.cfg.RetainSent)).
+		Delete()
+	return err
+}
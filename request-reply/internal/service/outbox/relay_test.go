@@ -0,0 +1,33 @@
+package outbox
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRemainingDelayCountsFromCreation(t *testing.T) {
+	created := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		delay int
+		now   time.Time
+		want  int
+	}{
+		{"undelayed", 0, created.Add(time.Second), 0},
+		{"published right away", 60, created, 60},
+		{"published late", 60, created.Add(45 * time.Second), 15},
+		{"rounded up", 60, created.Add(45*time.Second + time.Millisecond), 15},
+		{"retried after the due time", 60, created.Add(2 * time.Minute), 0},
+		{"exactly due", 60, created.Add(time.Minute), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &record{DelaySeconds: tt.delay, CreatedAt: created}
+			if got := remainingDelay(rec, tt.now); got != tt.want {
+				t.Fatalf("remainingDelay = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
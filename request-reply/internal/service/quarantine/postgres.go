@@ -0,0 +1,65 @@
+package quarantine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+// PostgresStore keeps quarantined messages in the
+// quarantined_messages table
+type PostgresStore struct {
+	db *pg.DB
+}
+
+func NewPostgresStore(db *pg.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Put(ctx context.Context, m *Message) error {
+	if m.QuarantinedAt.IsZero() {
+		m.QuarantinedAt = time.Now().UTC()
+	}
+	if _, err := s.db.ModelContext(ctx, m).Insert(); err != nil {
+		return fmt.Errorf("quarantining message: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) List(ctx context.Context, before int64, limit int) ([]*Message, error) {
+	var messages []*Message
+	q := s.db.ModelContext(ctx, &messages).Order("id DESC").Limit(limit)
+	if before > 0 {
+		q = q.Where("id < ?", before)
+	}
+	if err := q.Select(); err != nil {
+		return nil, fmt.Errorf("listing quarantined messages: %w", err)
+	}
+	return messages, nil
+}
+
+func (s *PostgresStore) Get(ctx context.Context, id int64) (*Message, error) {
+	m := new(Message)
+	err := s.db.ModelContext(ctx, m).Where("id = ?", id).Select()
+	if errors.Is(err, pg.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting quarantined message: %w", err)
+	}
+	return m, nil
+}
+
+func (s *PostgresStore) Delete(ctx context.Context, id int64) error {
+	res, err := s.db.ModelContext(ctx, (*Message)(nil)).Where("id = ?", id).Delete()
+	if err != nil {
+		return fmt.Errorf("deleting quarantined message: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
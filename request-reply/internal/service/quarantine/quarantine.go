@@ -0,0 +1,35 @@
+package quarantine
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrNotFound = errors.New("quarantined message not found")
+
+// Message is a queue message that can never be processed, kept
+// with its raw body so it can be inspected and fixed by hand
+type Message struct {
+	tableName struct{} `pg:"quarantined_messages"`
+
+	ID int64 `pg:"id,pk" json:"id"`
+	// the SQS message id, the body may not have a readable one
+	MessageID     string            `pg:"message_id" json:"message_id"`
+	QueueURL      string            `pg:"queue_url" json:"queue_url"`
+	Body          string            `pg:"body,use_zero" json:"body"`
+	Error         string            `pg:"error" json:"error"`
+	Attributes    map[string]string `pg:"attributes,type:jsonb" json:"attributes,omitempty"`
+	QuarantinedAt time.Time         `pg:"quarantined_at" json:"quarantined_at"`
+}
+
+// Store keeps quarantined messages, the consumer deletes the
+// original from the queue once Put succeeds
+type Store interface {
+	Put(ctx context.Context, m *Message) error
+	// List returns the newest messages first, ids below
+	// before only when before is not zero
+	List(ctx context.Context, before int64, limit int) ([]*Message, error)
+	Get(ctx context.Context, id int64) (*Message, error)
+	Delete(ctx context.Context, id int64) error
+}
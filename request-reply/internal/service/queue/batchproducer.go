@@ -0,0 +1,334 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// maximum total payload of a single SendMessageBatch request
+const maxBatchBytes = 256 * 1024
+
+var ErrBatchProducerClosed = errors.New("batch producer is closed")
+
+// SendFuture is resolved once the message it belongs to
+// is accepted by SQS or all retries are exhausted
+type SendFuture struct {
+	done chan struct{}
+	// SQS message id
+	id  string
+	err error
+}
+
+func newSendFuture() *SendFuture {
+	return &SendFuture{done: make(chan struct{})}
+}
+
+func (f *SendFuture) resolve(id string, err error) {
+	f.id = id
+	f.err = err
+	close(f.done)
+}
+
+// Done is closed when the result is available
+func (f *SendFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the message is sent, returns the
+// message id SQS assigned, not Message.ID
+func (f *SendFuture) Wait(ctx context.Context) (string, error) {
+	select {
+	case <-f.done:
+		return f.id, f.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+type pendingMessage struct {
+	msg      *Message
+	size     int
+	attempts int
+	future   *SendFuture
+}
+
+type BatchProducerConfig struct {
+	// flush when this many messages are buffered, max 10
+	MaxBatchSize int
+	// flush when buffered bodies reach this many bytes
+	MaxBatchBytes int
+	// flush a non-empty buffer after this long
+	// even if it is not full
+	Linger time.Duration
+	// how many times an entry reported as failed
+	// by SQS is sent again
+	MaxRetries int
+	// wait between retries, doubled on every attempt
+	RetryBackoff time.Duration
+	// batches sent at the same time, a batch waiting for
+	// a retry keeps its slot but doesn't stop buffering
+	MaxInflight int
+}
+
+// BatchProducer buffers single messages and sends them
+// with SendMessageBatch, so high volume callers make
+// one SQS call per batch instead of one per message
+type BatchProducer struct {
+	producer *Producer
+	cfg      BatchProducerConfig
+
+	in       chan *pendingMessage
+	closing  chan struct{}
+	stopped  chan struct{}
+	closeOne sync.Once
+	mu       sync.RWMutex
+	closed   bool
+	// SendMessage calls that passed the closed check,
+	// run keeps receiving until they are done
+	senders sync.WaitGroup
+
+	inflight chan struct{}
+	sending  sync.WaitGroup
+}
+
+func NewBatchProducer(producer *Producer, cfg BatchProducerConfig) *BatchProducer {
+
+	if cfg.MaxBatchSize <= 0 || cfg.MaxBatchSize > maxBatchSize {
+		cfg.MaxBatchSize = maxBatchSize
+	}
+
+	if cfg.MaxBatchBytes <= 0 || cfg.MaxBatchBytes > maxBatchBytes {
+		cfg.MaxBatchBytes = maxBatchBytes
+	}
+
+	if cfg.Linger <= 0 {
+		cfg.Linger = 50 * time.Millisecond
+	}
+
+	if cfg.MaxRetries < 0 {
+		cfg.MaxRetries = 0
+	}
+
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = 100 * time.Millisecond
+	}
+
+	if cfg.MaxInflight <= 0 {
+		cfg.MaxInflight = 4
+	}
+
+	b := &BatchProducer{
+		producer: producer,
+		cfg:      cfg,
+		in:       make(chan *pendingMessage, cfg.MaxBatchSize*4),
+		closing:  make(chan struct{}),
+		stopped:  make(chan struct{}),
+		inflight: make(chan struct{}, cfg.MaxInflight),
+	}
+
+	go b.run()
+
+	return b
+}
+
+// SendMessage adds the message to the current batch, the returned
+// future is resolved when the batch containing it is flushed
+func (b *BatchProducer) SendMessage(ctx context.Context, m *Message) *SendFuture {
+	f := newSendFuture()
+
+	// stamped with the caller's ctx, which carries the trace
+	size, err := b.producer.messageSize(ctx, m)
+	if err != nil {
+		f.resolve("", err)
+		return f
+	}
+	if size > b.cfg.MaxBatchBytes {
+		f.resolve("", fmt.Errorf("message %s is %d bytes, limit is %d", m.ID, size, b.cfg.MaxBatchBytes))
+		return f
+	}
+
+	// the lock is not held while blocking on a full
+	// buffer, Close would wait for it past its ctx
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		f.resolve("", ErrBatchProducerClosed)
+		return f
+	}
+	b.senders.Add(1)
+	b.mu.RUnlock()
+	defer b.senders.Done()
+
+	select {
+	case b.in <- &pendingMessage{msg: m, size: size, future: f}:
+	case <-ctx.Done():
+		f.resolve("", ctx.Err())
+	}
+	return f
+}
+
+// Close stops accepting messages and flushes what is buffered,
+// it returns when every pending future is resolved or ctx ends
+func (b *BatchProducer) Close(ctx context.Context) error {
+	b.closeOne.Do(func() {
+		b.mu.Lock()
+		b.closed = true
+		b.mu.Unlock()
+		close(b.closing)
+	})
+
+	select {
+	case <-b.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *BatchProducer) run() {
+	defer close(b.stopped)
+
+	var (
+		batch []*pendingMessage
+		bytes int
+	)
+
+	timer := time.NewTimer(b.cfg.Linger)
+	timer.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		timer.Stop()
+		b.send(batch)
+		batch = nil
+		bytes = 0
+	}
+
+	add := func(pm *pendingMessage) {
+		if bytes+pm.size > b.cfg.MaxBatchBytes {
+			flush()
+		}
+		if len(batch) == 0 {
+			timer.Reset(b.cfg.Linger)
+		}
+		batch = append(batch, pm)
+		bytes += pm.size
+		if len(batch) >= b.cfg.MaxBatchSize {
+			flush()
+		}
+	}
+
+	for {
+		select {
+		case pm := <-b.in:
+			add(pm)
+		case <-timer.C:
+			flush()
+		case <-b.closing:
+			// nothing can be added once closed is set, take what
+			// the senders still in SendMessage hand over
+			sendersDone := make(chan struct{})
+			go func() {
+				b.senders.Wait()
+				close(sendersDone)
+			}()
+			for {
+				select {
+				case pm := <-b.in:
+					add(pm)
+				case <-timer.C:
+					flush()
+				case <-sendersDone:
+					for len(b.in) > 0 {
+						add(<-b.in)
+					}
+					flush()
+					b.sending.Wait()
+					return
+				}
+			}
+		}
+	}
+}
+
+// send flushes the batch in the background so retries don't hold
+// up buffering, it blocks only when MaxInflight batches are out
+func (b *BatchProducer) send(batch []*pendingMessage) {
+	b.inflight <- struct{}{}
+	b.sending.Add(1)
+	go func() {
+		defer func() {
+			<-b.inflight
+			b.sending.Done()
+		}()
+		b.flush(batch)
+	}()
+}
+
+// flush sends the batch and retries the entries SQS reports
+// as failed, every future in the batch is resolved on return
+func (b *BatchProducer) flush(batch []*pendingMessage) {
+	ctx := context.Background()
+	backoff := b.cfg.RetryBackoff
+
+	for len(batch) > 0 {
+		messages := make([]*Message, len(batch))
+		byID := make(map[string]*pendingMessage, len(batch))
+		for i, pm := range batch {
+			messages[i] = pm.msg
+			byID[pm.msg.ID] = pm
+			pm.attempts++
+		}
+
+		var retry []*pendingMessage
+
+		res, err := b.producer.SendMessageBatch(ctx, messages)
+		if err != nil {
+			slog.Error("sending message batch", "error", err, "size", len(batch))
+			for _, pm := range batch {
+				if pm.attempts > b.cfg.MaxRetries {
+					pm.future.resolve("", err)
+					continue
+				}
+				retry = append(retry, pm)
+			}
+		} else {
+			failed := make(map[string]BatchSendError)
+			var sent map[string]string
+			if res != nil {
+				sent = res.Sent
+				for _, f := range res.Failed {
+					if f.MessageID == "" {
+						continue
+					}
+					failed[f.MessageID] = f
+				}
+			}
+
+			for id, pm := range byID {
+				f, ok := failed[id]
+				if !ok {
+					pm.future.resolve(sent[id], nil)
+					continue
+				}
+				if pm.attempts > b.cfg.MaxRetries {
+					pm.future.resolve("", fmt.Errorf("sending message %s: %s: %s", id, f.Code, f.Message))
+					continue
+				}
+				retry = append(retry, pm)
+			}
+		}
+
+		if len(retry) > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		batch = retry
+	}
+}
@@ -0,0 +1,114 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBatchProducerSendsFullBatches(t *testing.T) {
+	fake, client := newFakeSQS(t)
+	b := NewBatchProducer(NewProducer(client, "q"), BatchProducerConfig{MaxBatchSize: 10, Linger: time.Hour})
+
+	var futures []*SendFuture
+	for i := 0; i < 25; i++ {
+		futures = append(futures, b.SendMessage(context.Background(), &Message{ID: fmt.Sprintf("m%d", i), Type: "user.create"}))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, f := range futures {
+		id, err := f.Wait(ctx)
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if want := fmt.Sprintf("sqs-m%d", i); id != want {
+			t.Fatalf("message %d got id %s, want the SQS id %s", i, id, want)
+		}
+	}
+	if n := fake.requestCount(); n != 3 {
+		t.Fatalf("%d requests, want 3 batches for 25 messages", n)
+	}
+}
+
+func TestBatchProducerFlushesAfterLinger(t *testing.T) {
+	_, client := newFakeSQS(t)
+	b := NewBatchProducer(NewProducer(client, "q"), BatchProducerConfig{Linger: 10 * time.Millisecond})
+	defer b.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := b.SendMessage(ctx, &Message{ID: "m", Type: "user.create"}).Wait(ctx); err != nil {
+		t.Fatalf("a lone message was not flushed: %v", err)
+	}
+}
+
+func TestBatchProducerRetriesFailedEntries(t *testing.T) {
+	fake, client := newFakeSQS(t)
+	fake.failEntry("q", "bad")
+	b := NewBatchProducer(NewProducer(client, "q"), BatchProducerConfig{
+		Linger:       time.Millisecond,
+		MaxRetries:   2,
+		RetryBackoff: time.Millisecond,
+	})
+	defer b.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := b.SendMessage(ctx, &Message{ID: "bad", Type: "user.create"}).Wait(ctx); err == nil {
+		t.Fatal("want an error once the retries are used up")
+	}
+	if n := fake.requestCount(); n != 3 {
+		t.Fatalf("%d requests, want the first attempt and 2 retries", n)
+	}
+}
+
+func TestBatchProducerRejectsAfterClose(t *testing.T) {
+	_, client := newFakeSQS(t)
+	b := NewBatchProducer(NewProducer(client, "q"), BatchProducerConfig{})
+	if err := b.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := b.SendMessage(context.Background(), &Message{Type: "user.create"}).Wait(context.Background())
+	if !errors.Is(err, ErrBatchProducerClosed) {
+		t.Fatalf("got %v, want ErrBatchProducerClosed", err)
+	}
+}
+
+func TestBatchProducerCloseIsNotHeldUpByBlockedSenders(t *testing.T) {
+	// nothing reads the buffer, a sender blocks on it
+	b := &BatchProducer{
+		producer: NewProducer(nil, "q"),
+		cfg:      BatchProducerConfig{MaxBatchBytes: maxBatchBytes},
+		in:       make(chan *pendingMessage),
+		closing:  make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	sendCtx, stopSend := context.WithCancel(context.Background())
+	defer stopSend()
+	go b.SendMessage(sendCtx, &Message{Type: "user.create"})
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- b.Close(ctx) }()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got %v, want the ctx error", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked past its ctx")
+	}
+}
@@ -0,0 +1,57 @@
+package queue
+
+import (
+	"context"
+	"sync"
+)
+
+// cancellations holds the cancel funcs of the messages
+// that are being processed, keyed by message id
+type cancellations struct {
+	mu      sync.Mutex
+	running map[string]*cancelEntry
+}
+
+type cancelEntry struct {
+	cancel context.CancelCauseFunc
+}
+
+func newCancellations() *cancellations {
+	return &cancellations{running: make(map[string]*cancelEntry)}
+}
+
+// add registers the cancel func of a message, the returned
+// func removes it once the message is processed
+func (c *cancellations) add(id string, cancel context.CancelCauseFunc) func() {
+	e := &cancelEntry{cancel: cancel}
+
+	c.mu.Lock()
+	c.running[id] = e
+	c.mu.Unlock()
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.running[id] == e {
+			delete(c.running, id)
+		}
+	}
+}
+
+func (c *cancellations) cancel(id string) bool {
+	c.mu.Lock()
+	e, ok := c.running[id]
+	c.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+	e.cancel(ErrJobCancelled)
+	return true
+}
+
+// Cancel stops the handler processing the message with the given
+// id, it reports whether such a message was in flight on this consumer
+func (c *Consumer) Cancel(id string) bool {
+	return c.cancellations.cancel(id)
+}
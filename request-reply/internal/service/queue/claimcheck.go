@@ -0,0 +1,108 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/serdarozerr/request-reply/internal/service/blobstore"
+)
+
+// SQS rejects bodies above 256KB, keep some room for the envelope
+const defaultClaimCheckThreshold = 200 * 1024
+
+// claimCheck moves large payloads out of the message body into
+// a blob store, the body only carries a reference to the blob
+type claimCheck struct {
+	store     blobstore.BlobStore
+	threshold int
+}
+
+// WithClaimCheck makes the producer store payloads whose encoded
+// message exceeds thresholdBytes in store and send a reference instead
+func (p *Producer) WithClaimCheck(store blobstore.BlobStore, thresholdBytes int) *Producer {
+	if thresholdBytes <= 0 || thresholdBytes > maxBatchBytes {
+		thresholdBytes = defaultClaimCheckThreshold
+	}
+	p.claimCheck = &claimCheck{store: store, threshold: thresholdBytes}
+	return p
+}
+
+func claimCheckKey(messageID string) string {
+	return "payloads/" + messageID + ".json"
+}
+
+// encode returns the message body, checking the payload
+// in when the message is too large
+func (p *Producer) encode(ctx context.Context, m *Message) ([]byte, error) {
+	body, checkIn, err := p.marshal(m)
+	if err != nil || !checkIn {
+		return body, err
+	}
+
+	payload, err := json.Marshal(m.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("converting payload into json: %w", err)
+	}
+	if err := p.claimCheck.store.Put(ctx, claimCheckKey(m.ID), payload); err != nil {
+		return nil, fmt.Errorf("storing payload of message %s: %w", m.ID, err)
+	}
+	return body, nil
+}
+
+// marshal returns the body encode sends without storing anything,
+// checkIn reports whether the payload has to go to the blob store
+func (p *Producer) marshal(m *Message) (body []byte, checkIn bool, err error) {
+	body, err = json.Marshal(m)
+	if err != nil {
+		return nil, false, fmt.Errorf("converting message into json: %w", err)
+	}
+
+	if p.claimCheck == nil || len(body) <= p.claimCheck.threshold {
+		return body, false, nil
+	}
+
+	// the caller's message keeps its payload, only the body is checked in
+	checked := *m
+	checked.Payload = nil
+	checked.PayloadRef = claimCheckKey(m.ID)
+
+	body, err = json.Marshal(&checked)
+	if err != nil {
+		return nil, false, fmt.Errorf("converting message into json: %w", err)
+	}
+	return body, true, nil
+}
+
+// messageSize stamps the message and returns the size its batch
+// entry will have, the body and attributes sendBatch sends
+func (p *Producer) messageSize(ctx context.Context, m *Message) (int, error) {
+	p.stamp(ctx, m)
+	body, _, err := p.marshal(m)
+	if err != nil {
+		return 0, err
+	}
+	return entrySize(body, batchAttributes(m), traceAttribute(m)), nil
+}
+
+// rehydrate loads a checked in payload back into the message
+func rehydrate(ctx context.Context, store blobstore.BlobStore, msg *MessageConsumer) error {
+	if msg.PayloadRef == "" {
+		return nil
+	}
+	if store == nil {
+		return fmt.Errorf("message %s has a payload reference but no blob store is configured", msg.ID)
+	}
+
+	data, err := store.Get(ctx, msg.PayloadRef)
+	if err != nil {
+		return fmt.Errorf("loading payload %s: %w", msg.PayloadRef, err)
+	}
+
+	var payload map[string]any
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return fmt.Errorf("decoding payload %s: %w", msg.PayloadRef, err)
+	}
+	msg.Payload = payload
+	return nil
+}
@@ -3,31 +3,55 @@ package queue
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"log/slog"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/serdarozerr/request-reply/internal/service/blobstore"
+	"github.com/serdarozerr/request-reply/internal/service/encryption"
+	"github.com/serdarozerr/request-reply/internal/service/inbox"
+	"github.com/serdarozerr/request-reply/internal/service/quarantine"
 )
 
 type MessageConsumer struct{
 	ID string `json:"id"`
 	Type string `json:"type"`
 	Payload map[string]any `json:"payload"`
+	PayloadRef string `json:"payload_ref,omitempty"`
+	Encryption *encryption.Envelope `json:"encryption,omitempty"`
 	Timestamp time.Time `json:"timestamp"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Priority string `json:"priority,omitempty"`
+	TraceHeader string `json:"trace_header,omitempty"`
+	// lane and queue the message was received from
+	Lane string `json:"-"`
+	QueueURL string `json:"-"`
+	// start of the current visibility timeout
+	VisibleSince time.Time `json:"-"`
 	ReceiptHandle string `json:"-"`
 	Attributes map[string]string `json:"-"`
 }
 
-type Handler func(ctx context.Context, m* MessageConsumer) error
+// Handler processes a message, the result is stored
+// with the job when the consumer has a tracker
+type Handler func(ctx context.Context, m* MessageConsumer) (*Result, error)
+
+// Expired reports whether the message is past its expires_at
+func (m *MessageConsumer) Expired(now time.Time) bool {
+	return m.ExpiresAt != nil && !now.Before(*m.ExpiresAt)
+}
 
 type Consumer struct{
 	client* sqs.Client
-	queueURL string
+	// polled queues, a single default lane
+	// when no lanes are configured
+	lanes []*consumerLane
 	handler Handler
 	// total number of messages 
 	// in one call
@@ -42,14 +66,44 @@ type Consumer struct{
 	// wake up immediately
 	waitTimeSeconds int
 	workerCount int
+	// optional, skips messages that were
+	// already processed by any worker
+	inbox inbox.Store
+	// completed inbox entries are kept this long,
+	// redeliveries are rare after a few days
+	inboxRetention time.Duration
+	// optional, where checked in payloads
+	// are loaded from
+	blobStore blobstore.BlobStore
+	// decrypts the sensitive payload fields,
+	// required when messages carry them
+	keyProvider encryption.KeyProvider
+	// optional, records job status and attempts
+	tracker JobTracker
+	// prefix of the inbox lease owner
+	// of this consumer's workers
+	instanceID string
+	// handlers in flight, see Cancel
+	cancellations *cancellations
+	// optional, undecodable messages are moved here, without
+	// it they are left to the queue's redrive policy
+	quarantine quarantine.Store
 }
 
 type ConsumerConfig struct{
+	// queue of the default lane, used when Lanes is empty
 	QueueURL string
+	Lanes []Lane
 	MaxMessages int
 	VisibilityTimeout int
 	WaitTimeSeconds int
 	WorkerCount int
+	Inbox inbox.Store
+	InboxRetention time.Duration
+	BlobStore blobstore.BlobStore
+	KeyProvider encryption.KeyProvider
+	Tracker JobTracker
+	Quarantine quarantine.Store
 }
 
 func NewConsumer(client *sqs.Client, cfg ConsumerConfig, handler Handler) *Consumer{
@@ -70,13 +124,28 @@ func NewConsumer(client *sqs.Client, cfg ConsumerConfig, handler Handler) *Consu
 		cfg.WorkerCount=5
 	}
 
+	if cfg.InboxRetention<=0{
+		cfg.InboxRetention=7*24*time.Hour
+	}
+
+	hostname,_:=os.Hostname()
+
 	return &Consumer{
 		client: client,
 		handler: handler,
-		queueURL: cfg.QueueURL,
+		lanes: newConsumerLanes(cfg),
 		maxMessages: cfg.MaxMessages,
+		visibilityTimeout: cfg.VisibilityTimeout,
 		waitTimeSeconds: cfg.WaitTimeSeconds,
 		workerCount: cfg.WorkerCount,
+		inbox: cfg.Inbox,
+		inboxRetention: cfg.InboxRetention,
+		blobStore: cfg.BlobStore,
+		keyProvider: cfg.KeyProvider,
+		tracker: cfg.Tracker,
+		instanceID: fmt.Sprintf("%s-%d",hostname,os.Getpid()),
+		cancellations: newCancellations(),
+		quarantine: cfg.Quarantine,
 	}
 
 }
@@ -89,78 +158,261 @@ func (c *Consumer) Start(ctx context.Context)error{
 		wg.Add(1)
 		go func(workerID int) {
 			defer wg.Done()
-			c.work(ctx,msgChan)
+			c.work(ctx,workerID,msgChan)
 
 		}(i)
 	}
 
+	// every lane has its own poller, the dispatcher
+	// shares the workers between them by weight
+	wake := make(chan struct{}, 1)
+	for _, l := range c.lanes {
+		go c.poll(ctx, l, wake)
+	}
 	go func(){
-		c.pool(ctx,msgChan)
+		c.dispatch(ctx,wake,msgChan)
 		close(msgChan)
 	}()
 
+	if c.inbox != nil {
+		go c.purgeInbox(ctx)
+	}
+
 	wg.Wait()
 
 	return ctx.Err()
 }
 
-func (c *Consumer) work(ctx context.Context, msgChan <-chan *MessageConsumer){
+func (c *Consumer) work(ctx context.Context, workerID int, msgChan <-chan *MessageConsumer){
 
+	owner:=fmt.Sprintf("%s-%d",c.instanceID,workerID)
 	for msg := range msgChan{
 		select{
 		case <-ctx.Done():
 			return
 		default:
-			c.processMessage(ctx, msg)
+			c.processMessage(ctx, owner, msg)
 		}
 	}
 }
 
-func (c *Consumer) pool(ctx context.Context, msgChan chan<- *MessageConsumer){
-	for  {
+func (c *Consumer) purgeInbox(ctx context.Context){
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		n, err := c.inbox.Purge(ctx, time.Now().Add(-c.inboxRetention))
+		if err != nil {
+			slog.Error("purging inbox", "error", err)
+		} else if n > 0 {
+			slog.Info("purged inbox", "deleted", n)
+		}
+
 		select {
-			case <-ctx.Done():
-				return
-			default:
-				messages,err :=c.receiveMessages(ctx)
-				if err != nil{
-					slog.Error("receiving messages","error",err)
-					time.Sleep(time.Second)
-					continue
-				}
-
-				for _,m := range messages{
-					select{
-					case msgChan <-m:
-					case <-ctx.Done():
-						return
-					}
-				}
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
 	}
 }
 
-func (c *Consumer) processMessage(ctx context.Context, msg *MessageConsumer){
+func (c *Consumer) processMessage(ctx context.Context, owner string, msg *MessageConsumer){
+
+	// a message that waited in its lane's buffer may be close to
+	// becoming visible again, renew the timeout before it is handled
+	if !c.renewVisibility(ctx, msg) {
+		return
+	}
+
+	if c.inbox != nil {
+		err := c.inbox.Claim(ctx, msg.ID, owner, time.Duration(c.visibilityTimeout)*time.Second)
+		switch {
+		case errors.Is(err, inbox.ErrAlreadyCompleted):
+			slog.Info("skipping duplicate message", "id", msg.ID)
+			if err := c.deleteMessage(ctx, msg.QueueURL, msg.ReceiptHandle); err != nil {
+				slog.Info("Error deleting message", "id", msg.ID, "error", err)
+			}
+			return
+		case errors.Is(err, inbox.ErrLeased):
+			// the copy held by the other worker is either completed or
+			// released, this one becomes visible again in the meantime
+			slog.Info("message is processed by another worker", "id", msg.ID)
+			return
+		case err != nil:
+			slog.Error("claiming message", "id", msg.ID, "error", err)
+			return
+		}
+	}
+
+	// registered before the job is started, so a cancel
+	// arriving right after the start isn't missed
+	jobCtx,cancelJob:=context.WithCancelCause(ctx)
+	defer cancelJob(nil)
+	defer c.cancellations.add(msg.ID,cancelJob)()
+
+	attempt := 0
+	if c.tracker != nil {
+		var err error
+		attempt, err = c.tracker.Start(ctx, msg, owner)
+		switch {
+		case errors.Is(err, ErrJobFinished):
+			slog.Info("dropping message of finished job", "id", msg.ID)
+			c.complete(ctx, owner, msg)
+			return
+		case err != nil:
+			slog.Error("starting job", "id", msg.ID, "error", err)
+			c.release(ctx, owner, msg)
+			return
+		}
+	}
+
+	// a stale message is worse than none, it is dead
+	// lettered without running the handler
+	var err error
+	if msg.Expired(time.Now()) {
+		err = ErrMessageExpired
+	}
 
-	ctxT,cancel:=context.WithTimeout(ctx,time.Duration(time.Duration(c.visibilityTimeout-5)*time.Second))
+	ctxT,cancel:=context.WithDeadline(jobCtx,c.deadline(msg))
 	defer cancel()
 
-	err:=c.handler(ctxT,msg)
+	if err == nil {
+		err=rehydrate(ctxT,c.blobStore,msg)
+	}
+	if err == nil {
+		err=c.decrypt(ctxT,msg)
+	}
+	var result *Result
+	if err == nil {
+		result,err=c.handler(ctxT,msg)
+	}
+	if err != nil && errors.Is(context.Cause(jobCtx), ErrJobCancelled) {
+		err = ErrJobCancelled
+	}
+
+	if c.tracker != nil {
+		if ferr := c.tracker.Finish(ctx, msg, owner, attempt, result, err); ferr != nil {
+			slog.Error("finishing job", "id", msg.ID, "error", ferr)
+			// a lost result can't be recovered later,
+			// let the message be processed again
+			if err == nil {
+				err = ferr
+			}
+		}
+	}
+
+	if errors.Is(err, ErrJobCancelled) {
+		slog.Info("job cancelled while running", "id", msg.ID, "type", msg.Type)
+		err = nil
+	}
+
+	if errors.Is(err, ErrMessageExpired) {
+		slog.Warn("dropping expired message", "id", msg.ID, "type", msg.Type, "expires_at", msg.ExpiresAt)
+		err = nil
+	}
+
+	if IsPermanent(err) {
+		// retrying won't help, drop the message
+		slog.Error("message failed permanently", "id", msg.ID, "type", msg.Type, "error", err)
+		err = nil
+	}
 	 if err != nil {
         slog.Info("Error processing message %s: %v", msg.ID, err)
+		c.release(ctx, owner, msg)
         return
     }
 
-	 if err := c.deleteMessage(ctx, msg.ReceiptHandle); err != nil {
-        slog.Info("Error deleting message %s: %v", msg.ID, err)
-    }
+	if !c.complete(ctx, owner, msg) {
+		return
+	}
+
+	// the payload is not needed once the message is gone
+	if msg.PayloadRef != "" {
+		if err := c.blobStore.Delete(ctx, msg.PayloadRef); err != nil {
+			slog.Error("deleting checked in payload", "id", msg.ID, "ref", msg.PayloadRef, "error", err)
+		}
+	}
 }
 
 
-func (c *Consumer) receiveMessages(ctx context.Context)([]*MessageConsumer, error){
+// deadline is when the handler has to be done, the message's
+// expires_at when it comes before the visibility timeout
+func (c *Consumer) deadline(msg *MessageConsumer) time.Time {
+	d := msg.VisibleSince.Add(time.Duration(c.visibilityTimeout-5) * time.Second)
+	if msg.ExpiresAt != nil && msg.ExpiresAt.Before(d) {
+		return *msg.ExpiresAt
+	}
+	return d
+}
+
+// renewVisibility restarts the visibility timeout of a message that
+// was buffered for more than a third of it, it reports false when
+// the message can't be renewed and must be left to its redelivery
+func (c *Consumer) renewVisibility(ctx context.Context, msg *MessageConsumer) bool {
+	timeout := time.Duration(c.visibilityTimeout) * time.Second
+	if time.Since(msg.VisibleSince) < timeout/3 {
+		return true
+	}
+
+	renewed := time.Now()
+	_, err := c.client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(msg.QueueURL),
+		ReceiptHandle:     aws.String(msg.ReceiptHandle),
+		VisibilityTimeout: int32(c.visibilityTimeout),
+	})
+	if err != nil {
+		slog.Warn("renewing visibility of buffered message", "id", msg.ID, "lane", msg.Lane, "error", err)
+		return false
+	}
+	msg.VisibleSince = renewed
+	return true
+}
+
+// release lets a redelivery of the message be processed again
+func (c *Consumer) release(ctx context.Context, owner string, msg *MessageConsumer) {
+	if c.inbox == nil {
+		return
+	}
+	if err := c.inbox.Release(ctx, msg.ID, owner); err != nil {
+		slog.Error("releasing message", "id", msg.ID, "error", err)
+	}
+}
+
+// complete records the message as done and deletes it
+// from the queue, it reports whether the delete succeeded
+func (c *Consumer) complete(ctx context.Context, owner string, msg *MessageConsumer) bool {
+	if c.inbox != nil {
+		if err := c.inbox.Complete(ctx, msg.ID, owner); err != nil {
+			slog.Error("completing message", "id", msg.ID, "error", err)
+		}
+	}
+
+	if err := c.deleteMessage(ctx, msg.QueueURL, msg.ReceiptHandle); err != nil {
+		slog.Info("Error deleting message", "id", msg.ID, "error", err)
+		return false
+	}
+	return true
+}
+
+// decrypt opens the encrypted payload fields right before the
+// handler runs, they stay encrypted everywhere else
+func (c *Consumer) decrypt(ctx context.Context, msg *MessageConsumer) error {
+	if msg.Encryption == nil {
+		return nil
+	}
+	if c.keyProvider == nil {
+		return fmt.Errorf("message %s has encrypted fields but no key provider is configured", msg.ID)
+	}
+	if err := encryption.Open(ctx, c.keyProvider, msg.ID, msg.Payload, msg.Encryption); err != nil {
+		return fmt.Errorf("decrypting message %s: %w", msg.ID, err)
+	}
+	return nil
+}
+
+func (c *Consumer) receiveMessages(ctx context.Context, l *consumerLane)([]*MessageConsumer, error){
 
 in:=&sqs.ReceiveMessageInput{
-	QueueUrl: &c.queueURL,
+	QueueUrl: &l.QueueURL,
 	MaxNumberOfMessages: int32(c.maxMessages),
 	VisibilityTimeout: int32(c.visibilityTimeout),
 	WaitTimeSeconds: int32(c.waitTimeSeconds),
@@ -175,25 +427,98 @@ if err != nil{
 	return nil, fmt.Errorf("receiving messages: %w", err)
 }
 
-messages :=make([]*MessageConsumer, len(res.Messages))
-for i, m :=range res.Messages{
-	 var msg MessageConsumer
-    if err := json.Unmarshal([]byte(*m.Body), &msg); err != nil {
-        log.Printf("Error unmarshaling message %s: %v", *m.MessageId, err)
-        continue
-    }
+received := time.Now()
+messages :=make([]*MessageConsumer, 0, len(res.Messages))
+for _, m :=range res.Messages{
+	var msg MessageConsumer
+	if err := decodeMessage(m, &msg); err != nil {
+		c.quarantineMessage(ctx, l.QueueURL, m, err)
+		continue
+	}
 
-    msg.ReceiptHandle = *m.ReceiptHandle
-    msg.Attributes = m.Attributes
-    messages[i] = &msg
+	msg.VisibleSince = received
+	msg.Lane = l.Name
+	msg.QueueURL = l.QueueURL
+	msg.ReceiptHandle = *m.ReceiptHandle
+	msg.Attributes = m.Attributes
+	messages = append(messages, &msg)
 }
 return messages, nil
 }
 
-func (c *Consumer) deleteMessage(ctx context.Context, rh string )error{
+// decodeMessage fails for bodies no retry can make processable
+func decodeMessage(m types.Message, msg *MessageConsumer) error {
+	if m.Body == nil {
+		return errors.New("message has no body")
+	}
+	if err := json.Unmarshal([]byte(*m.Body), msg); err != nil {
+		return fmt.Errorf("decoding message body: %w", err)
+	}
+	switch {
+	case msg.ID == "":
+		return errors.New("message has no id")
+	case msg.Type == "":
+		return errors.New("message has no type")
+	case msg.Payload == nil && msg.PayloadRef == "":
+		return errors.New("message has no payload")
+	}
+	return nil
+}
+
+// quarantinedJobID is the id of a body that decodes but
+// fails validation, empty when there is none to read
+func quarantinedJobID(m types.Message) string {
+	var body struct {
+		ID string `json:"id"`
+	}
+	if m.Body == nil || json.Unmarshal([]byte(*m.Body), &body) != nil {
+		return ""
+	}
+	return body.ID
+}
+
+// quarantineMessage stores the raw message and deletes it from the
+// queue, if storing fails it stays and is tried again on redelivery
+func (c *Consumer) quarantineMessage(ctx context.Context, queueURL string, m types.Message, cause error) {
+	id := aws.ToString(m.MessageId)
+	slog.Error("undecodable message", "message_id", id, "error", cause)
+
+	if c.quarantine == nil {
+		return
+	}
+
+	err := c.quarantine.Put(ctx, &quarantine.Message{
+		MessageID:  id,
+		QueueURL:   queueURL,
+		Body:       aws.ToString(m.Body),
+		Error:      cause.Error(),
+		Attributes: m.Attributes,
+	})
+	if err != nil {
+		slog.Error("quarantining message", "message_id", id, "error", err)
+		return
+	}
+
+	// the job can't run anymore, without this it waits forever
+	if jobID := quarantinedJobID(m); jobID != "" {
+		if qt, ok := c.tracker.(QuarantineTracker); ok {
+			if err := qt.Quarantined(ctx, jobID, cause); err != nil {
+				slog.Error("failing quarantined job", "message_id", id, "job_id", jobID, "error", err)
+			}
+		}
+	}
+
+	if err := c.deleteMessage(ctx, queueURL, aws.ToString(m.ReceiptHandle)); err != nil {
+		slog.Error("deleting quarantined message", "message_id", id, "error", err)
+		return
+	}
+	slog.Warn("message quarantined", "message_id", id)
+}
+
+func (c *Consumer) deleteMessage(ctx context.Context, queueURL string, rh string )error{
 
 	in:=&sqs.DeleteMessageInput{
-		QueueUrl: &c.queueURL,
+		QueueUrl: &queueURL,
 		ReceiptHandle: &rh,
 	}
 
@@ -227,42 +552,39 @@ func (c *Consumer) DeleteMessageBatch(ctx context.Context, messages []*MessageCo
 		return nil, fmt.Errorf("batch size exceeds maximum of 10 messages")
 	}
 
-	entries := make([]types.DeleteMessageBatchRequestEntry, len(messages))
-	for i, m := range messages{
-		entries[i] = types.DeleteMessageBatchRequestEntry{
+	// messages of different lanes are deleted from their own queue
+	byQueue := make(map[string][]types.DeleteMessageBatchRequestEntry)
+	for _, m := range messages{
+		byQueue[m.QueueURL] = append(byQueue[m.QueueURL], types.DeleteMessageBatchRequestEntry{
 			Id: aws.String(m.ID),
 			ReceiptHandle: aws.String(m.ReceiptHandle),
-		}
+		})
 	}
 
-	in:=&sqs.DeleteMessageBatchInput{
-		QueueUrl: aws.String(c.queueURL),
-		Entries: entries,
-	}
-	  
-	result, err := c.client.DeleteMessageBatch(ctx, in)
-    if err != nil {
-        return nil, fmt.Errorf("batch deleting messages: %w", err)
-    }
-
-	batchResult := &BatchDeleteResult{
-        Successful: make([]string, len(result.Successful)),
-        Failed:     make([]BatchDeleteError, len(result.Failed)),
-    }
-
-    for i, s := range result.Successful {
-        batchResult.Successful[i] = *s.Id
-    }
+	batchResult := &BatchDeleteResult{}
+	for queueURL, entries := range byQueue{
+		in:=&sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(queueURL),
+			Entries: entries,
+		}
 
-    for i, f := range result.Failed {
-        batchResult.Failed[i] = BatchDeleteError{
-            ID:      *f.Id,
-            Code:    *f.Code,
-            Message: *f.Message,
-        }
-    }
+		result, err := c.client.DeleteMessageBatch(ctx, in)
+		if err != nil {
+			return nil, fmt.Errorf("batch deleting messages: %w", err)
+		}
 
-    return batchResult, nil
+		for _, s := range result.Successful {
+			batchResult.Successful = append(batchResult.Successful, *s.Id)
+		}
 
+		for _, f := range result.Failed {
+			batchResult.Failed = append(batchResult.Failed, BatchDeleteError{
+				ID:      *f.Id,
+				Code:    *f.Code,
+				Message: *f.Message,
+			})
+		}
+	}
 
-}
\ No newline at end of file
+	return batchResult, nil
+}
@@ -0,0 +1,41 @@
+package queue
+
+import "errors"
+
+// PermanentError marks a failure that will not go away on retry,
+// the consumer deletes the message instead of letting it redeliver
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return "permanent: " + e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+func IsPermanent(err error) bool {
+	var p *PermanentError
+	return errors.As(err, &p)
+}
+
+// ErrJobFinished is returned by a JobTracker when the job of a
+// message is already in a terminal state, the message is dropped
+var ErrJobFinished = errors.New("job is already finished")
+
+// ErrMessageExpired is passed to the JobTracker for messages
+// received after their expires_at, the handler is not run
+var ErrMessageExpired = errors.New("message expired")
+
+// ErrJobCancelled is the cause of a handler context cancelled
+// through Consumer.Cancel
+var ErrJobCancelled = errors.New("job was cancelled")
@@ -0,0 +1,135 @@
+package queue
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// fakeSQS answers SendMessage and SendMessageBatch like SQS does,
+// requests to a failing queue get a QueueDoesNotExist error
+type fakeSQS struct {
+	mu sync.Mutex
+	// queue url -> bodies accepted by the queue
+	sent map[string][]string
+	// queue url -> message ids failed as entries of a batch
+	failEntries map[string]map[string]bool
+	failing     map[string]bool
+	requests    int
+}
+
+type fakeEntry struct {
+	Id                      string
+	MessageBody             string
+	MessageAttributes       map[string]any
+	MessageSystemAttributes map[string]any
+}
+
+func newFakeSQS(t *testing.T) (*fakeSQS, *sqs.Client) {
+	t.Helper()
+
+	f := &fakeSQS{
+		sent:        make(map[string][]string),
+		failEntries: make(map[string]map[string]bool),
+		failing:     make(map[string]bool),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(srv.Close)
+
+	client := sqs.New(sqs.Options{
+		Region:                           "us-east-1",
+		BaseEndpoint:                     aws.String(srv.URL),
+		Credentials:                      credentials.NewStaticCredentialsProvider("key", "secret", ""),
+		RetryMaxAttempts:                 1,
+		DisableMessageChecksumValidation: true,
+	})
+	return f, client
+}
+
+func (f *fakeSQS) fail(queueURL string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing[queueURL] = true
+}
+
+func (f *fakeSQS) failEntry(queueURL, id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failEntries[queueURL] == nil {
+		f.failEntries[queueURL] = make(map[string]bool)
+	}
+	f.failEntries[queueURL][id] = true
+}
+
+func (f *fakeSQS) bodies(queueURL string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.sent[queueURL]...)
+}
+
+func (f *fakeSQS) requestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+func (f *fakeSQS) serve(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		QueueUrl    string
+		MessageBody string
+		Entries     []fakeEntry
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	if f.failing[in.QueueUrl] {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"__type":  "com.amazonaws.sqs#QueueDoesNotExist",
+			"message": "queue does not exist",
+		})
+		return
+	}
+
+	switch op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSQS."); op {
+	case "SendMessage":
+		f.sent[in.QueueUrl] = append(f.sent[in.QueueUrl], in.MessageBody)
+		json.NewEncoder(w).Encode(map[string]string{"MessageId": "sqs-" + in.QueueUrl})
+	case "SendMessageBatch":
+		type result struct {
+			Id          string
+			MessageId   string `json:",omitempty"`
+			Code        string `json:",omitempty"`
+			SenderFault bool   `json:",omitempty"`
+		}
+		var out struct {
+			Successful []result
+			Failed     []result
+		}
+		for _, e := range in.Entries {
+			if f.failEntries[in.QueueUrl][e.Id] {
+				out.Failed = append(out.Failed, result{Id: e.Id, Code: "InternalError"})
+				continue
+			}
+			f.sent[in.QueueUrl] = append(f.sent[in.QueueUrl], e.MessageBody)
+			out.Successful = append(out.Successful, result{Id: e.Id, MessageId: "sqs-" + e.Id})
+		}
+		json.NewEncoder(w).Encode(out)
+	default:
+		http.Error(w, "unsupported operation "+op, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/serdarozerr/request-reply/internal/service/queue"
+)
+
+// batchCallback posts the summary of a completed batch to its
+// callback url, server errors are retried, client errors are not
+func (h *Handlers) batchCallback(ctx context.Context, msg *queue.MessageConsumer)(*queue.Result, error){
+	url, _ := msg.Payload["url"].(string)
+	if url == "" {
+		return nil, queue.Permanent(fmt.Errorf("callback payload is missing the url"))
+	}
+
+	body, err := json.Marshal(msg.Payload["batch"])
+	if err != nil {
+		return nil, queue.Permanent(fmt.Errorf("encoding batch summary: %w", err))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, queue.Permanent(fmt.Errorf("creating callback request: %w", err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", msg.ID)
+
+	res, err := h.client.Do(req)
+	if errors.Is(err, ErrForbiddenAddress) {
+		return nil, queue.Permanent(fmt.Errorf("posting batch callback: %w", err))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("posting batch callback: %w", err)
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests:
+		return nil, fmt.Errorf("batch callback returned %s", res.Status)
+	case res.StatusCode >= 300:
+		// redirects are not followed, they could lead inside
+		return nil, queue.Permanent(fmt.Errorf("batch callback returned %s", res.Status))
+	}
+
+	slog.Info("batch callback posted", "id", msg.ID, "url", url, "status", res.StatusCode)
+	return queue.JSONResult(map[string]any{"status_code": res.StatusCode})
+}
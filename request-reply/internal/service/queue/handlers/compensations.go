@@ -0,0 +1,15 @@
+package handlers
+
+import "github.com/serdarozerr/request-reply/internal/service/workflow"
+
+// RegisterCompensations registers how the handled message types are
+// undone when a later workflow step fails
+func RegisterCompensations() {
+	// the created user is removed again
+	workflow.RegisterCompensation("user.create", workflow.Compensation{
+		Type: "user.delete",
+		Payload: func(payload map[string]any, result any) map[string]any {
+			return map[string]any{"email": payload["email"]}
+		},
+	})
+}
@@ -1,22 +1,41 @@
 package handlers
 
 import (
-	"context"
-	"log/slog"
+	"net/http"
+	"time"
 
+	"github.com/go-pg/pg/v10"
+	"github.com/serdarozerr/request-reply/internal/service/batch"
 	"github.com/serdarozerr/request-reply/internal/service/queue"
 )
 
-func MessageHandler(ctx context.Context, msg *queue.MessageConsumer)error{
-	slog.Info("Processing message", "id", msg.ID, "type", msg.Type)
+type Handlers struct{
+	db *pg.DB
+	// posts batch completion callbacks
+	client *http.Client
+}
 
-	switch msg.Type{
-	case "user.create":
-		return userCreate(ctx,msg)
-	case "user.delete":
-		return userDelete(ctx,msg)
-	default:
-		slog.Info("Unknown message type" , "type", msg.Type)
-		return nil
-	}
-}
\ No newline at end of file
+func New(db *pg.DB) *Handlers{
+	return &Handlers{db: db, client: newCallbackClient(10 * time.Second)}
+}
+
+// Router returns the message handler, every route is wrapped in
+// tracing, logging, metrics and recovery, routes add their own
+// payload validation and timeout. Recover is innermost so a
+// panic is still traced, logged and counted
+func (h *Handlers) Router(metrics queue.MetricsSink, spans queue.SpanExporter) queue.Handler{
+	r:=queue.NewRouter()
+	r.Use(queue.Tracing(spans), queue.Logging(), queue.Instrument(metrics), queue.Recover())
+
+	r.Handle("user.create", h.userCreate,
+		queue.RequireFields("name", "email", "password"),
+		queue.Timeout(10*time.Second))
+	r.Handle("user.delete", h.userDelete,
+		queue.RequireFields("email"),
+		queue.Timeout(10*time.Second))
+	// the http client has its own timeout
+	r.Handle(batch.CallbackType, h.batchCallback,
+		queue.RequireFields("url", "batch"))
+
+	return r.Handler()
+}
@@ -2,20 +2,72 @@ package handlers
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
-	"time"
 
+	"github.com/serdarozerr/request-reply/internal/models"
 	"github.com/serdarozerr/request-reply/internal/service/queue"
+	"golang.org/x/crypto/bcrypt"
 )
-func userCreate(ctx context.Context, msg *queue.MessageConsumer)error{
-	time.Sleep(100*time.Millisecond)
-	slog.Info("user creation is done", "msg",msg.Payload)
-	return nil
+
+func (h *Handlers) userCreate(ctx context.Context, msg *queue.MessageConsumer)(*queue.Result, error){
+	name, _ := msg.Payload["name"].(string)
+	email, _ := msg.Payload["email"].(string)
+	password, _ := msg.Payload["password"].(string)
+	// numbers are decoded from JSON as float64
+	age, _ := msg.Payload["age"].(float64)
+
+	if name == "" || email == "" || password == "" || age <= 0 {
+		return nil, queue.Permanent(fmt.Errorf("user payload is missing required fields"))
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, queue.Permanent(fmt.Errorf("hashing password: %w", err))
+	}
+
+	user := &models.User{
+		Name:     name,
+		Email:    email,
+		Age:      uint(age),
+		Password: string(hash),
+		JobID:    msg.ID,
+	}
+	err = models.InsertUser(h.db.WithContext(ctx), user)
+	if errors.Is(err, models.ErrEmailTaken) {
+		// the user was created by an earlier delivery of this
+		// job whose outcome wasn't recorded
+		existing, gerr := models.GetUserByEmail(h.db.WithContext(ctx), email)
+		if gerr != nil {
+			return nil, fmt.Errorf("reading existing user: %w", gerr)
+		}
+		if existing.JobID != msg.ID {
+			return nil, queue.Permanent(err)
+		}
+		user = existing
+	} else if err != nil {
+		return nil, fmt.Errorf("inserting user: %w", err)
+	}
+
+	slog.Info("user creation is done", "id",msg.ID)
+	return queue.JSONResult(map[string]any{"user_id": user.ID, "email": user.Email})
 }
 
 
-func userDelete(ctx context.Context, msg *queue.MessageConsumer)error{
-	time.Sleep(100*time.Millisecond)
-	slog.Info("user deletion is done", "msg",msg.Payload)
-	return nil
+func (h *Handlers) userDelete(ctx context.Context, msg *queue.MessageConsumer)(*queue.Result, error){
+	email, _ := msg.Payload["email"].(string)
+	if email == "" {
+		return nil, queue.Permanent(fmt.Errorf("user payload is missing the email"))
+	}
+
+	deleted, err := models.DeleteUserByEmail(h.db.WithContext(ctx), email)
+	if err != nil {
+		return nil, fmt.Errorf("deleting user: %w", err)
+	}
+
+	// deleting a missing user is not an error, the
+	// message may be a redelivery of a completed one
+	slog.Info("user deletion is done", "id",msg.ID, "deleted", deleted)
+	return queue.JSONResult(map[string]any{"email": email, "deleted": deleted})
 }
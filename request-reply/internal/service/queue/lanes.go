@@ -0,0 +1,161 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// DefaultLane is the lane of the queue the producer and
+// consumer are created with
+const DefaultLane = "default"
+
+// lanes of Message.Priority that callers set explicitly,
+// messages of a lane that isn't configured use the type route
+const (
+	PriorityHigh = "high"
+	PriorityLow  = "low"
+)
+
+// Lane is a queue of its own, consumers give it a share of the
+// receive calls and workers proportional to its weight
+type Lane struct {
+	Name     string
+	QueueURL string
+	Weight   int
+}
+
+// WithLanes routes messages to a lane queue, by their Priority
+// when it names a lane, otherwise by types (message type -> lane
+// name). Messages matching neither go to the producer's queue
+func (p *Producer) WithLanes(lanes []Lane, types map[string]string) error {
+	p.lanes = make(map[string]string, len(lanes))
+	for _, l := range lanes {
+		if l.Name == "" || l.QueueURL == "" {
+			return fmt.Errorf("lane %q needs a name and a queue url", l.Name)
+		}
+		p.lanes[l.Name] = l.QueueURL
+	}
+	for t, lane := range types {
+		if _, ok := p.lanes[lane]; !ok {
+			return fmt.Errorf("type %s is routed to unknown lane %q", t, lane)
+		}
+	}
+	p.laneTypes = types
+	return nil
+}
+
+// queueFor returns the queue url of the message's lane
+func (p *Producer) queueFor(m *Message) string {
+	if url, ok := p.lanes[m.Priority]; ok {
+		return url
+	}
+	if url, ok := p.lanes[p.laneTypes[m.Type]]; ok {
+		return url
+	}
+	return p.queueURL
+}
+
+// consumerLane is a lane polled by the consumer, current is its
+// smooth weighted round robin counter, only the dispatcher uses it
+type consumerLane struct {
+	Lane
+	msgs    chan *MessageConsumer
+	current int
+}
+
+func newConsumerLanes(cfg ConsumerConfig) []*consumerLane {
+	lanes := cfg.Lanes
+	if len(lanes) == 0 {
+		lanes = []Lane{{Name: DefaultLane, QueueURL: cfg.QueueURL, Weight: 1}}
+	}
+
+	cls := make([]*consumerLane, len(lanes))
+	for i, l := range lanes {
+		if l.Weight <= 0 {
+			l.Weight = 1
+		}
+		cls[i] = &consumerLane{Lane: l, msgs: make(chan *MessageConsumer, cfg.MaxMessages)}
+	}
+	return cls
+}
+
+// poll keeps the lane's buffer filled, a lane whose messages are
+// not dispatched blocks here so it doesn't receive more than it
+// can hand out
+func (c *Consumer) poll(ctx context.Context, l *consumerLane, wake chan<- struct{}) {
+	for ctx.Err() == nil {
+		messages, err := c.receiveMessages(ctx, l)
+		if err != nil {
+			slog.Error("receiving messages", "lane", l.Name, "error", err)
+			timer := time.NewTimer(time.Second)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+			continue
+		}
+
+		for _, m := range messages {
+			select {
+			case l.msgs <- m:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// dispatch hands buffered messages to the workers, the lane is
+// picked by smooth weighted round robin among the lanes that have
+// messages, so every lane gets its share and idle lanes cost nothing
+func (c *Consumer) dispatch(ctx context.Context, wake <-chan struct{}, msgChan chan<- *MessageConsumer) {
+	for {
+		l := c.nextLane()
+		if l == nil {
+			select {
+			case <-wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		// only the dispatcher reads from the lanes,
+		// a non-empty one doesn't block
+		m := <-l.msgs
+		select {
+		case msgChan <- m:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Consumer) nextLane() *consumerLane {
+	var (
+		best  *consumerLane
+		total int
+	)
+	for _, l := range c.lanes {
+		if len(l.msgs) == 0 {
+			continue
+		}
+		l.current += l.Weight
+		total += l.Weight
+		if best == nil || l.current > best.current {
+			best = l
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
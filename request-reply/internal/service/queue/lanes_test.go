@@ -0,0 +1,137 @@
+package queue
+
+import (
+	"fmt"
+	"testing"
+)
+
+// lanesWith returns consumer lanes whose buffers hold n messages each
+func lanesWith(n int, lanes ...Lane) []*consumerLane {
+	cls := newConsumerLanes(ConsumerConfig{Lanes: lanes, MaxMessages: n})
+	for _, l := range cls {
+		for i := 0; i < n; i++ {
+			l.msgs <- &MessageConsumer{ID: fmt.Sprintf("%s-%d", l.Name, i)}
+		}
+	}
+	return cls
+}
+
+func TestNextLaneSharesByWeight(t *testing.T) {
+	c := &Consumer{lanes: lanesWith(100,
+		Lane{Name: PriorityHigh, Weight: 6},
+		Lane{Name: DefaultLane, Weight: 3},
+		Lane{Name: PriorityLow, Weight: 1},
+	)}
+
+	picks := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		picks[c.nextLane().Name]++
+	}
+
+	want := map[string]int{PriorityHigh: 60, DefaultLane: 30, PriorityLow: 10}
+	for name, n := range want {
+		if picks[name] != n {
+			t.Errorf("lane %s picked %d times, want %d", name, picks[name], n)
+		}
+	}
+}
+
+func TestNextLaneDoesNotStarve(t *testing.T) {
+	c := &Consumer{lanes: lanesWith(100,
+		Lane{Name: PriorityHigh, Weight: 50},
+		Lane{Name: PriorityLow, Weight: 1},
+	)}
+
+	// the low lane gets a turn in every round of total weight picks
+	last := -1
+	for i := 0; i < 102; i++ {
+		if c.nextLane().Name != PriorityLow {
+			continue
+		}
+		if last >= 0 && i-last > 51 {
+			t.Fatalf("low lane waited %d picks, want at most 51", i-last)
+		}
+		last = i
+	}
+	if last < 0 {
+		t.Fatal("low lane was never picked")
+	}
+}
+
+func TestNextLaneSkipsEmptyLanes(t *testing.T) {
+	lanes := newConsumerLanes(ConsumerConfig{
+		Lanes: []Lane{
+			{Name: PriorityHigh, Weight: 6},
+			{Name: PriorityLow, Weight: 1},
+		},
+		MaxMessages: 1,
+	})
+	c := &Consumer{lanes: lanes}
+
+	if l := c.nextLane(); l != nil {
+		t.Fatalf("picked lane %s with nothing buffered", l.Name)
+	}
+
+	lanes[1].msgs <- &MessageConsumer{ID: "low"}
+	for i := 0; i < 3; i++ {
+		if l := c.nextLane(); l == nil || l.Name != PriorityLow {
+			t.Fatalf("pick %d: want the only lane with messages", i)
+		}
+	}
+}
+
+func TestNewConsumerLanesDefaults(t *testing.T) {
+	lanes := newConsumerLanes(ConsumerConfig{QueueURL: "default-url", MaxMessages: 10})
+	if len(lanes) != 1 || lanes[0].Name != DefaultLane || lanes[0].QueueURL != "default-url" || lanes[0].Weight != 1 {
+		t.Fatalf("got %+v, want a single default lane of weight 1", lanes[0].Lane)
+	}
+
+	lanes = newConsumerLanes(ConsumerConfig{Lanes: []Lane{{Name: PriorityLow}}})
+	if lanes[0].Weight != 1 {
+		t.Fatalf("weight %d, want 1 for a lane without one", lanes[0].Weight)
+	}
+}
+
+func laneProducer(t *testing.T) *Producer {
+	t.Helper()
+	p := NewProducer(nil, "default-url")
+	err := p.WithLanes([]Lane{
+		{Name: DefaultLane, QueueURL: "default-url"},
+		{Name: PriorityHigh, QueueURL: "high-url"},
+		{Name: PriorityLow, QueueURL: "low-url"},
+	}, map[string]string{"user.create": PriorityHigh})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestQueueFor(t *testing.T) {
+	p := laneProducer(t)
+
+	tests := []struct {
+		name string
+		msg  Message
+		want string
+	}{
+		{"type route", Message{Type: "user.create"}, "high-url"},
+		{"priority wins over type", Message{Type: "user.create", Priority: PriorityLow}, "low-url"},
+		{"unknown priority uses type", Message{Type: "user.create", Priority: "urgent"}, "high-url"},
+		{"unrouted type", Message{Type: "user.delete"}, "default-url"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.queueFor(&tt.msg); got != tt.want {
+				t.Errorf("queueFor = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithLanesRejectsUnknownLane(t *testing.T) {
+	p := NewProducer(nil, "default-url")
+	err := p.WithLanes([]Lane{{Name: DefaultLane, QueueURL: "default-url"}}, map[string]string{"user.create": PriorityHigh})
+	if err == nil {
+		t.Fatal("want an error for a type routed to a lane that isn't configured")
+	}
+}
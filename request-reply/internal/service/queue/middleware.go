@@ -0,0 +1,305 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HandlerMiddleware wraps a Handler, like pkg/middleware does
+// for http handlers
+type HandlerMiddleware func(Handler) Handler
+
+// Chain wraps h so the first middleware runs outermost
+func Chain(h Handler, mws ...HandlerMiddleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Recover turns a panicking handler into a failed attempt, the
+// message is redelivered instead of the worker process crashing.
+// Add it last so the middlewares around it see the failure
+func Recover() HandlerMiddleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, m *MessageConsumer) (res *Result, err error) {
+			defer func() {
+				if p := recover(); p != nil {
+					slog.Error("handler panicked", "id", m.ID, "type", m.Type, "panic", p, "stack", string(debug.Stack()))
+					res, err = nil, fmt.Errorf("handler panicked: %v", p)
+				}
+			}()
+			return next(ctx, m)
+		}
+	}
+}
+
+// Logging logs the outcome of every message with its fields
+func Logging() HandlerMiddleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, m *MessageConsumer) (*Result, error) {
+			start := time.Now()
+			res, err := next(ctx, m)
+
+			attrs := []any{
+				"id", m.ID,
+				"type", m.Type,
+				"receive_count", m.Attributes["ApproximateReceiveCount"],
+				"duration", time.Since(start),
+			}
+			if span, ok := SpanFromContext(ctx); ok {
+				attrs = append(attrs, "trace_id", span.TraceID, "span_id", span.SpanID)
+			}
+
+			switch {
+			case err == nil:
+				slog.Info("message handled", attrs...)
+			case IsPermanent(err):
+				slog.Error("message failed permanently", append(attrs, "error", err)...)
+			default:
+				slog.Warn("message failed", append(attrs, "error", err)...)
+			}
+			return res, err
+		}
+	}
+}
+
+// Timeout bounds the handler, use it per route for
+// types that are slower or faster than the default
+func Timeout(d time.Duration) HandlerMiddleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, m *MessageConsumer) (*Result, error) {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			return next(ctx, m)
+		}
+	}
+}
+
+// Validate rejects payloads check returns an error for, they
+// won't become valid on retry so the failure is permanent
+func Validate(check func(payload map[string]any) error) HandlerMiddleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, m *MessageConsumer) (*Result, error) {
+			if err := check(m.Payload); err != nil {
+				return nil, Permanent(fmt.Errorf("invalid %s payload: %w", m.Type, err))
+			}
+			return next(ctx, m)
+		}
+	}
+}
+
+// RequireFields validates that the payload has the fields and
+// they are not empty
+func RequireFields(fields ...string) HandlerMiddleware {
+	return Validate(func(payload map[string]any) error {
+		var missing []string
+		for _, f := range fields {
+			if v, ok := payload[f]; !ok || v == nil || v == "" {
+				missing = append(missing, f)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("missing fields: %s", strings.Join(missing, ", "))
+		}
+		return nil
+	})
+}
+
+// Span identifies one handler run, the trace id is taken from
+// the message's X-Ray header when it has one
+type Span struct {
+	TraceID string
+	SpanID  string
+	// span of the producer that sent the message, if known
+	ParentID string
+	Name     string
+	Start    time.Time
+	End      time.Time
+	// set when the handler failed
+	Error string
+}
+
+// Header is the X-Ray trace header that continues the
+// trace in the messages sent while the span is active
+func (s *Span) Header() string {
+	return "Root=" + s.TraceID + ";Parent=" + s.SpanID + ";Sampled=1"
+}
+
+// SpanExporter ships finished spans to a tracing backend
+type SpanExporter interface {
+	ExportSpan(ctx context.Context, span *Span)
+}
+
+// LogSpanExporter writes finished spans to the debug log,
+// for running without a tracing backend
+type LogSpanExporter struct{}
+
+func (LogSpanExporter) ExportSpan(ctx context.Context, span *Span) {
+	slog.DebugContext(ctx, "span",
+		"trace_id", span.TraceID,
+		"span_id", span.SpanID,
+		"parent_id", span.ParentID,
+		"name", span.Name,
+		"duration", span.End.Sub(span.Start),
+		"error", span.Error)
+}
+
+type spanKey struct{}
+
+func SpanFromContext(ctx context.Context) (*Span, bool) {
+	span, ok := ctx.Value(spanKey{}).(*Span)
+	return span, ok
+}
+
+// Tracing starts a span per message and hands it to exporter when
+// the handler returns, messages the handler sends with a Producer
+// continue the trace
+func Tracing(exporter SpanExporter) HandlerMiddleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, m *MessageConsumer) (*Result, error) {
+			traceID, parentID := parseTraceHeader(traceHeader(m))
+			if traceID == "" {
+				traceID = newTraceID()
+			}
+			span := &Span{
+				TraceID:  traceID,
+				SpanID:   randomID(8),
+				ParentID: parentID,
+				Name:     m.Type,
+				Start:    time.Now(),
+			}
+			ctx = context.WithValue(ctx, spanKey{}, span)
+
+			res, err := next(ctx, m)
+
+			span.End = time.Now()
+			if err != nil {
+				span.Error = err.Error()
+			}
+			if exporter != nil {
+				exporter.ExportSpan(ctx, span)
+			}
+			return res, err
+		}
+	}
+}
+
+// traceHeader prefers the header SQS received from the sender,
+// the body keeps it for messages relayed through the outbox
+func traceHeader(m *MessageConsumer) string {
+	if h := m.Attributes["AWSTraceHeader"]; h != "" {
+		return h
+	}
+	return m.TraceHeader
+}
+
+// parseTraceHeader reads Root=... and Parent=... of an X-Ray header
+func parseTraceHeader(header string) (traceID, parentID string) {
+	for _, part := range strings.Split(header, ";") {
+		if id, ok := strings.CutPrefix(part, "Root="); ok {
+			traceID = id
+		}
+		if id, ok := strings.CutPrefix(part, "Parent="); ok {
+			parentID = id
+		}
+	}
+	return traceID, parentID
+}
+
+// newTraceID returns an X-Ray trace id, SQS rejects trace
+// headers in any other format
+func newTraceID() string {
+	return fmt.Sprintf("1-%08x-%s", time.Now().Unix(), randomID(12))
+}
+
+// InjectTrace stamps the trace of the span in ctx on m, the producer
+// does it on send, call it for messages written to the outbox
+func InjectTrace(ctx context.Context, m *Message) {
+	if m.TraceHeader != "" {
+		return
+	}
+	if span, ok := SpanFromContext(ctx); ok {
+		m.TraceHeader = span.Header()
+	}
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// TypeMetrics are the counters of one message type
+type TypeMetrics struct {
+	Handled     int64         `json:"handled"`
+	Failed      int64         `json:"failed"`
+	Duration    time.Duration `json:"duration"`
+	MaxDuration time.Duration `json:"max_duration"`
+}
+
+// Metrics counts handled messages per type
+type Metrics struct {
+	mu    sync.Mutex
+	types map[string]*TypeMetrics
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{types: make(map[string]*TypeMetrics)}
+}
+
+// MetricsSink receives the outcome of every handled message,
+// implement it to ship the numbers to a metrics backend
+type MetricsSink interface {
+	Observe(msgType string, d time.Duration, err error)
+}
+
+// Observe implements MetricsSink
+func (mt *Metrics) Observe(msgType string, d time.Duration, err error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	t, ok := mt.types[msgType]
+	if !ok {
+		t = &TypeMetrics{}
+		mt.types[msgType] = t
+	}
+	t.Handled++
+	if err != nil {
+		t.Failed++
+	}
+	t.Duration += d
+	t.MaxDuration = max(t.MaxDuration, d)
+}
+
+// Snapshot returns a copy of the counters
+func (mt *Metrics) Snapshot() map[string]TypeMetrics {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	snap := make(map[string]TypeMetrics, len(mt.types))
+	for k, v := range mt.types {
+		snap[k] = *v
+	}
+	return snap
+}
+
+// Instrument records every message in sink, Metrics keeps
+// them in memory
+func Instrument(sink MetricsSink) HandlerMiddleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, m *MessageConsumer) (*Result, error) {
+			start := time.Now()
+			res, err := next(ctx, m)
+			sink.Observe(m.Type, time.Since(start), err)
+			return res, err
+		}
+	}
+}
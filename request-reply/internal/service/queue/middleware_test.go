@@ -0,0 +1,75 @@
+package queue
+
+import (
+	"context"
+	"testing"
+)
+
+// spanRecorder keeps the exported spans
+type spanRecorder struct {
+	spans []*Span
+}
+
+func (r *spanRecorder) ExportSpan(ctx context.Context, span *Span) {
+	r.spans = append(r.spans, span)
+}
+
+func TestTraceHeaderRoundTrip(t *testing.T) {
+	span := &Span{TraceID: newTraceID(), SpanID: randomID(8)}
+
+	m := &Message{}
+	InjectTrace(context.WithValue(context.Background(), spanKey{}, span), m)
+
+	traceID, parentID := parseTraceHeader(m.TraceHeader)
+	if traceID != span.TraceID || parentID != span.SpanID {
+		t.Fatalf("parsed %s/%s from %q, want %s/%s", traceID, parentID, m.TraceHeader, span.TraceID, span.SpanID)
+	}
+}
+
+func TestTracingContinuesTrace(t *testing.T) {
+	var got *Span
+	h := Tracing(nil)(func(ctx context.Context, m *MessageConsumer) (*Result, error) {
+		got, _ = SpanFromContext(ctx)
+		return nil, nil
+	})
+
+	m := &MessageConsumer{Attributes: map[string]string{
+		"AWSTraceHeader": "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1",
+	}}
+	if _, err := h(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.TraceID != "1-5759e988-bd862e3fe1be46a994272793" || got.ParentID != "53995c3f42cd8ad8" {
+		t.Fatalf("span %+v doesn't continue the message's trace", got)
+	}
+	if got.End.IsZero() {
+		t.Fatal("span was not ended")
+	}
+}
+
+func TestPanickingHandlerIsRecoveredCountedAndTraced(t *testing.T) {
+	spans := &spanRecorder{}
+	metrics := NewMetrics()
+
+	r := NewRouter()
+	r.Use(Tracing(spans), Logging(), Instrument(metrics), Recover())
+	r.Handle("user.create", func(ctx context.Context, m *MessageConsumer) (*Result, error) {
+		panic("boom")
+	})
+
+	_, err := r.Handler()(context.Background(), &MessageConsumer{ID: "a", Type: "user.create"})
+	if err == nil {
+		t.Fatal("panic was not turned into an error")
+	}
+
+	if got := metrics.Snapshot()["user.create"]; got.Handled != 1 || got.Failed != 1 {
+		t.Fatalf("metrics %+v, want the panic counted as a failure", got)
+	}
+	if len(spans.spans) != 1 {
+		t.Fatalf("%d spans exported, want 1", len(spans.spans))
+	}
+	if span := spans.spans[0]; span.End.IsZero() || span.Error == "" {
+		t.Fatalf("span %+v, want it ended with the error", span)
+	}
+}
@@ -2,14 +2,15 @@ package queue
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/google/uuid"
+	"github.com/serdarozerr/request-reply/internal/service/encryption"
 )
 
 const version="1.0.0"
@@ -17,6 +18,11 @@ const version="1.0.0"
 type Producer struct{
 	client* sqs.Client
 	queueURL string
+	// optional, see WithClaimCheck
+	claimCheck *claimCheck
+	// optional, see WithLanes
+	lanes map[string]string
+	laneTypes map[string]string
 }
 
 type Message struct{
@@ -24,7 +30,21 @@ type Message struct{
 	ID string `json:"id"`
 	Type string `json:"type"`
 	Payload map[string]any `json:"payload"`
+	// blob store key of the payload when it
+	// was too large to be sent in the body
+	PayloadRef string `json:"payload_ref,omitempty"`
+	// set when sensitive payload fields are encrypted
+	Encryption *encryption.Envelope `json:"encryption,omitempty"`
 	Timestamp time.Time `json:"timestamp"`
+	// optional, the message is not processed after this
+	// time and the handler has to finish before it
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// optional, name of the lane the message is sent to
+	// regardless of its type, e.g. PriorityLow for bulk work
+	Priority string `json:"priority,omitempty"`
+	// X-Ray header of the trace the message belongs to,
+	// see InjectTrace
+	TraceHeader string `json:"trace_header,omitempty"`
 }
 
 func NewProducer(client *sqs.Client, queueURL string) *Producer{
@@ -39,13 +59,14 @@ func (p* Producer) SendMessage(ctx context.Context,m *Message, delaySeconds int
 	if m.ID ==""{
 		m.ID=uuid.New().String()
 	}
+	InjectTrace(ctx,m)
 
-	body,err:=json.Marshal(m)
+	body,err:=p.encode(ctx,m)
 	if err !=nil{
-		return "", fmt.Errorf("converting message into json: %w",err)
+		return "", err
 	}
 
-	in:=&sqs.SendMessageInput{QueueUrl: &p.queueURL, 
+	in:=&sqs.SendMessageInput{QueueUrl: aws.String(p.queueFor(m)), 
 		MessageBody: aws.String(string(body)), 
 		DelaySeconds: int32(delaySeconds),
 		MessageAttributes: map[string]types.MessageAttributeValue{
@@ -59,6 +80,8 @@ func (p* Producer) SendMessage(ctx context.Context,m *Message, delaySeconds int
 			},
 		},
 	}
+	setEncryptionAttribute(in.MessageAttributes, m)
+	in.MessageSystemAttributes=traceAttribute(m)
 
 	res,err:=p.client.SendMessage(ctx, in)
 	if err!=nil{
@@ -76,10 +99,11 @@ func (p* Producer)SendFIFOMessage(ctx context.Context, m *Message, messageGroupI
 	if m.ID ==""{
 		m.ID=uuid.New().String()
 	}
+	InjectTrace(ctx,m)
 
-	body,err:=json.Marshal(m)
+	body,err:=p.encode(ctx,m)
 	if err !=nil{
-		return "", fmt.Errorf("converting message into json: %w",err)
+		return "", err
 	}
 
 	if deDuplicationId == ""{
@@ -91,6 +115,7 @@ func (p* Producer)SendFIFOMessage(ctx context.Context, m *Message, messageGroupI
 		MessageBody: aws.String(string(body)),
 		MessageGroupId: aws.String(messageGroupId),
 		MessageDeduplicationId:aws.String(deDuplicationId),
+		MessageSystemAttributes: traceAttribute(m),
 	}
 
 	result, err := p.client.SendMessage(ctx, in)
@@ -112,6 +137,8 @@ type BatchSendError struct{
 
 type BatchSendResult struct {
 	Succesfull []string
+	// message id -> SQS message id of the sent messages
+	Sent map[string]string
 	Failed []BatchSendError
 }
 
@@ -126,57 +153,290 @@ func(p* Producer) SendMessageBatch(ctx context.Context, messages []*Message)(*Ba
 		return nil, fmt.Errorf("batch size must be less then %d",maxBatchSize)
 	}
 
-	entries:=make([]types.SendMessageBatchRequestEntry, len(messages))
-
-	for i, m := range messages{
-		m.Version=version
-		m.Timestamp=time.Now().UTC()
+	// one request per lane, a batch goes to a single queue
+	var (
+		queues []string
+		byQueue = make(map[string][]*Message)
+	)
+	for _, m := range messages{
 		if m.ID == ""{
 			m.ID=uuid.New().String()
 		}
+		url := p.queueFor(m)
+		if _, ok := byQueue[url]; !ok{
+			queues = append(queues, url)
+		}
+		byQueue[url] = append(byQueue[url], m)
+	}
+
+	// a lane that fails doesn't undo the ones SQS accepted, its
+	// messages are reported as failed so only they are sent again
+	batchResult:=&BatchSendResult{Sent: make(map[string]string, len(messages))}
+	var lastErr error
+	for _, url := range queues{
+		result, err := p.sendBatch(ctx, byQueue[url])
+		if err != nil {
+			lastErr = err
+			for _, m := range byQueue[url]{
+				batchResult.Failed=append(batchResult.Failed, BatchSendError{MessageID: m.ID, Code: "SendError", Message: err.Error()})
+			}
+			continue
+		}
+
+		for _, s :=range result.Successful{
+			batchResult.Succesfull=append(batchResult.Succesfull, *s.MessageId)
+			batchResult.Sent[aws.ToString(s.Id)]=aws.ToString(s.MessageId)
+		}
 
-		body, err := json.Marshal(m)
+		for _, f := range result.Failed{
+			batchResult.Failed=append(batchResult.Failed, batchSendError(f))
+		}
+	}
+
+	if len(batchResult.Succesfull) == 0 && lastErr != nil{
+		return nil, lastErr
+	}
+	return batchResult,nil
+
+}
+
+// sendBatch sends messages of the same lane, the queue is
+// taken from the first one
+func (p *Producer) sendBatch(ctx context.Context, messages []*Message) (*sqs.SendMessageBatchOutput, error) {
+	entries:=make([]types.SendMessageBatchRequestEntry, len(messages))
+
+	size := 0
+	for i, m := range messages{
+		p.stamp(ctx, m)
+
+		body, err := p.encode(ctx, m)
         if err != nil {
-            return nil, fmt.Errorf("marshaling message %d: %w", i, err)
+            return nil, fmt.Errorf("encoding message %d: %w", i, err)
         }
 
 		entries[i] = types.SendMessageBatchRequestEntry{
 			Id: aws.String(m.ID), 
 			MessageBody: aws.String(string(body)),
-			MessageAttributes: map[string]types.MessageAttributeValue{
-				"MessageType":{
-					DataType: aws.String("string"),
-					StringValue: aws.String(m.Type),
-				},
-			},
+			MessageAttributes: batchAttributes(m),
+			MessageSystemAttributes: traceAttribute(m),
 		}
+		size += entrySize(body, entries[i].MessageAttributes, entries[i].MessageSystemAttributes)
 	}
 
-	in:=&sqs.SendMessageBatchInput{QueueUrl: &p.queueURL, Entries: entries}
+	if size > maxBatchBytes {
+		return nil, fmt.Errorf("batch payload is %d bytes, limit is %d", size, maxBatchBytes)
+	}
+
+	in:=&sqs.SendMessageBatchInput{QueueUrl: aws.String(p.queueFor(messages[0])), Entries: entries}
 
 	result, err := p.client.SendMessageBatch(ctx, in)
     if err != nil {
         return nil, fmt.Errorf("batch sending messages: %w", err)
     }
+	return result, nil
+}
 
+// stamp sets the fields a batch entry is sent with, a message keeps
+// its timestamp so its size doesn't change between chunking and
+// sending
+func (p *Producer) stamp(ctx context.Context, m *Message) {
+	m.Version = version
+	if m.Timestamp.IsZero() {
+		m.Timestamp = time.Now().UTC()
+	}
+	if m.ID == "" {
+		m.ID = uuid.New().String()
+	}
+	InjectTrace(ctx, m)
+}
 
-	batchResult:=&BatchSendResult{
-		Succesfull: make([]string, len(messages)),
-		Failed: make([]BatchSendError, len(messages)),
+func batchAttributes(m *Message) map[string]types.MessageAttributeValue {
+	attrs := map[string]types.MessageAttributeValue{
+		"MessageType": {
+			DataType:    aws.String("String"),
+			StringValue: aws.String(m.Type),
+		},
 	}
+	setEncryptionAttribute(attrs, m)
+	return attrs
+}
 
-	for i, s :=range result.Successful{
-		batchResult.Succesfull[i]=*s.MessageId
+// entrySize is what SQS counts against the batch limit, the body
+// and the name, type and value of every attribute
+func entrySize(body []byte, attrs map[string]types.MessageAttributeValue, system map[string]types.MessageSystemAttributeValue) int {
+	size := len(body)
+	for name, a := range attrs {
+		size += len(name) + len(aws.ToString(a.DataType)) + len(aws.ToString(a.StringValue)) + len(a.BinaryValue)
+	}
+	for name, a := range system {
+		size += len(name) + len(aws.ToString(a.DataType)) + len(aws.ToString(a.StringValue)) + len(a.BinaryValue)
 	}
+	return size
+}
 
-	for i, f := range result.Failed{
-		batchResult.Failed[i]=BatchSendError{
-			MessageID: *f.Id,
-			Code:      *f.Code,
-            Message:   *f.Message,
+// SQS passes AWSTraceHeader on to the consumer
+func traceAttribute(m *Message) map[string]types.MessageSystemAttributeValue {
+	if m.TraceHeader == "" {
+		return nil
+	}
+	return map[string]types.MessageSystemAttributeValue{
+		string(types.MessageSystemAttributeNameForSendsAWSTraceHeader): {
+			DataType:    aws.String("String"),
+			StringValue: aws.String(m.TraceHeader),
+		},
+	}
+}
+
+// the key id lets operators see which master key a queued
+// message depends on before retiring a key during rotation
+func setEncryptionAttribute(attrs map[string]types.MessageAttributeValue, m *Message) {
+	if m.Encryption == nil {
+		return
+	}
+	attrs["EncryptionKeyId"] = types.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(m.Encryption.KeyID),
+	}
+}
+
+func batchSendError(f types.BatchResultErrorEntry) BatchSendError {
+	return BatchSendError{
+		MessageID: aws.ToString(f.Id),
+		Code:      aws.ToString(f.Code),
+		Message:   aws.ToString(f.Message),
+	}
+}
+
+// -------------------------------------> Bulk Send
+
+// BulkSendResult is keyed by Message.ID
+type BulkSendResult struct {
+	// message id -> SQS message id
+	Sent map[string]string
+	Failed map[string]BatchSendError
+}
+
+const defaultBulkParallelism = 4
+
+// SendMessageBulk sends any number of messages, they are split into
+// batches that respect the SQS count and size limits and at most
+// parallelism batches are in flight at the same time
+func (p *Producer) SendMessageBulk(ctx context.Context, messages []*Message, parallelism int) (*BulkSendResult, error) {
+	if parallelism <= 0 {
+		parallelism = defaultBulkParallelism
+	}
+
+	bulk := &BulkSendResult{
+		Sent:   make(map[string]string, len(messages)),
+		Failed: make(map[string]BatchSendError),
+	}
+
+	chunks, tooLarge := p.chunkMessages(ctx, messages)
+	for _, f := range tooLarge {
+		bulk.Failed[f.MessageID] = f
+	}
+
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, parallelism)
+	)
+
+	for i, chunk := range chunks {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			// chunks that were never sent are failures too,
+			// every message ends up in Sent or Failed
+			for _, rest := range chunks[i:] {
+				for _, m := range rest {
+					bulk.Failed[m.ID] = BatchSendError{MessageID: m.ID, Code: "NotAttempted", Message: ctx.Err().Error()}
+				}
+			}
+			return bulk, ctx.Err()
 		}
+
+		wg.Add(1)
+		go func(chunk []*Message) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result, err := p.sendBatch(ctx, chunk)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				for _, m := range chunk {
+					bulk.Failed[m.ID] = BatchSendError{MessageID: m.ID, Code: "SendError", Message: err.Error()}
+				}
+				return
+			}
+			for _, s := range result.Successful {
+				bulk.Sent[aws.ToString(s.Id)] = aws.ToString(s.MessageId)
+			}
+			for _, f := range result.Failed {
+				bulk.Failed[aws.ToString(f.Id)] = batchSendError(f)
+			}
+		}(chunk)
 	}
 
-	return batchResult,nil
+	wg.Wait()
+	return bulk, nil
+}
 
-}
\ No newline at end of file
+// chunkMessages groups messages of the same lane into batches of at
+// most maxBatchSize entries and maxBatchBytes payload, messages that
+// can't fit even in an empty batch are returned as failures
+func (p *Producer) chunkMessages(ctx context.Context, messages []*Message) ([][]*Message, []BatchSendError) {
+	type pending struct {
+		messages []*Message
+		bytes    int
+	}
+
+	var (
+		chunks   [][]*Message
+		queues   []string
+		current  = make(map[string]*pending)
+		tooLarge []BatchSendError
+	)
+
+	for _, m := range messages {
+		size, err := p.messageSize(ctx, m)
+		if err != nil {
+			tooLarge = append(tooLarge, BatchSendError{MessageID: m.ID, Code: "InvalidMessage", Message: err.Error()})
+			continue
+		}
+		if size > maxBatchBytes {
+			tooLarge = append(tooLarge, BatchSendError{
+				MessageID: m.ID,
+				Code:      "MessageTooLarge",
+				Message:   fmt.Sprintf("message is %d bytes, limit is %d", size, maxBatchBytes),
+			})
+			continue
+		}
+
+		url := p.queueFor(m)
+		c, ok := current[url]
+		if !ok {
+			c = &pending{}
+			current[url] = c
+			queues = append(queues, url)
+		}
+		if len(c.messages) == maxBatchSize || c.bytes+size > maxBatchBytes {
+			chunks = append(chunks, c.messages)
+			c.messages = nil
+			c.bytes = 0
+		}
+		c.messages = append(c.messages, m)
+		c.bytes += size
+	}
+
+	for _, url := range queues {
+		if c := current[url]; len(c.messages) > 0 {
+			chunks = append(chunks, c.messages)
+		}
+	}
+	return chunks, tooLarge
+}
@@ -0,0 +1,178 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/serdarozerr/request-reply/internal/service/encryption"
+)
+
+func TestSendMessageBatchKeepsLanesThatWereSent(t *testing.T) {
+	fake, client := newFakeSQS(t)
+	p := NewProducer(client, "default-url")
+	err := p.WithLanes([]Lane{
+		{Name: DefaultLane, QueueURL: "default-url"},
+		{Name: PriorityHigh, QueueURL: "high-url"},
+	}, map[string]string{"user.create": PriorityHigh})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.fail("high-url")
+
+	var messages []*Message
+	for i := 0; i < 3; i++ {
+		messages = append(messages, &Message{ID: fmt.Sprintf("d%d", i), Type: "user.delete", Payload: map[string]any{"n": i}})
+	}
+	for i := 0; i < 2; i++ {
+		messages = append(messages, &Message{ID: fmt.Sprintf("h%d", i), Type: "user.create", Payload: map[string]any{"n": i}})
+	}
+
+	res, err := p.SendMessageBatch(context.Background(), messages)
+	if err != nil {
+		t.Fatalf("got %v, want the failed lane reported per message", err)
+	}
+
+	if len(res.Succesfull) != 3 {
+		t.Fatalf("%d sent, want the 3 messages of the default lane", len(res.Succesfull))
+	}
+	failed := make(map[string]bool)
+	for _, f := range res.Failed {
+		failed[f.MessageID] = true
+	}
+	if len(failed) != 2 || !failed["h0"] || !failed["h1"] {
+		t.Fatalf("failed %+v, want h0 and h1", res.Failed)
+	}
+	if n := len(fake.bodies("default-url")); n != 3 {
+		t.Fatalf("default queue got %d messages, want 3", n)
+	}
+}
+
+func TestSendMessageBatchFailsWhenNothingIsSent(t *testing.T) {
+	fake, client := newFakeSQS(t)
+	p := NewProducer(client, "default-url")
+	fake.fail("default-url")
+
+	res, err := p.SendMessageBatch(context.Background(), []*Message{{ID: "a", Type: "user.delete"}})
+	if err == nil || res != nil {
+		t.Fatalf("got %+v, %v, want an error", res, err)
+	}
+}
+
+func TestChunkMessages(t *testing.T) {
+	p := laneProducer(t)
+
+	var messages []*Message
+	for i := 0; i < 25; i++ {
+		messages = append(messages, &Message{ID: fmt.Sprintf("d%d", i), Type: "user.delete", Payload: map[string]any{"n": i}})
+	}
+	for i := 0; i < 3; i++ {
+		messages = append(messages, &Message{ID: fmt.Sprintf("h%d", i), Type: "user.create", Payload: map[string]any{"n": i}})
+	}
+	messages = append(messages, &Message{ID: "big", Type: "user.delete", Payload: map[string]any{"blob": strings.Repeat("x", maxBatchBytes)}})
+
+	chunks, tooLarge := p.chunkMessages(context.Background(), messages)
+
+	if len(tooLarge) != 1 || tooLarge[0].MessageID != "big" || tooLarge[0].Code != "MessageTooLarge" {
+		t.Fatalf("tooLarge = %+v, want only the oversized message", tooLarge)
+	}
+
+	var sizes []int
+	for _, c := range chunks {
+		url := p.queueFor(c[0])
+		for _, m := range c {
+			if p.queueFor(m) != url {
+				t.Fatalf("chunk mixes queues %s and %s", url, p.queueFor(m))
+			}
+		}
+		sizes = append(sizes, len(c))
+	}
+	if fmt.Sprint(sizes) != "[10 10 5 3]" {
+		t.Fatalf("chunk sizes %v, want [10 10 5 3]", sizes)
+	}
+}
+
+func TestChunkMessagesCountsWhatIsSent(t *testing.T) {
+	fake, client := newFakeSQS(t)
+	p := NewProducer(client, "q")
+
+	// the trace header and the key id attribute are added on send
+	ctx := context.WithValue(context.Background(), spanKey{}, &Span{TraceID: newTraceID(), SpanID: randomID(8)})
+	newMessage := func(i, n int) *Message {
+		return &Message{
+			ID:         fmt.Sprintf("m%02d", i),
+			Type:       "user.create",
+			Payload:    map[string]any{"blob": strings.Repeat("x", n)},
+			Encryption: &encryption.Envelope{KeyID: "key-1", WrappedKey: "wrapped", Fields: []string{"blob"}},
+		}
+	}
+
+	// entries sized so exactly three fill a batch
+	base, err := p.messageSize(ctx, newMessage(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := maxBatchBytes/3 - base
+
+	var messages []*Message
+	for i := 0; i < 9; i++ {
+		messages = append(messages, newMessage(i, n))
+	}
+
+	chunks, tooLarge := p.chunkMessages(ctx, messages)
+	if len(tooLarge) != 0 || len(chunks) != 3 {
+		t.Fatalf("%d chunks, %d too large, want 3 full chunks", len(chunks), len(tooLarge))
+	}
+
+	res, err := p.SendMessageBulk(ctx, messages, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Failed) != 0 {
+		t.Fatalf("failed %+v, want every chunk within the batch limit", res.Failed)
+	}
+	if got := len(fake.bodies("q")); got != 9 {
+		t.Fatalf("queue got %d messages, want 9", got)
+	}
+}
+
+func TestSendMessageBulkReportsEveryMessage(t *testing.T) {
+	fake, client := newFakeSQS(t)
+	p := NewProducer(client, "q")
+	fake.failEntry("q", "m3")
+
+	var messages []*Message
+	for i := 0; i < 25; i++ {
+		messages = append(messages, &Message{ID: fmt.Sprintf("m%d", i), Type: "user.create"})
+	}
+
+	res, err := p.SendMessageBulk(context.Background(), messages, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Sent) != 24 || res.Sent["m0"] != "sqs-m0" {
+		t.Fatalf("sent %v, want 24 messages with their SQS ids", res.Sent)
+	}
+	if len(res.Failed) != 1 || res.Failed["m3"].Code != "InternalError" {
+		t.Fatalf("failed %+v, want m3", res.Failed)
+	}
+}
+
+func TestSendMessageBulkFailsMessagesNotSentBeforeCancel(t *testing.T) {
+	_, client := newFakeSQS(t)
+	p := NewProducer(client, "q")
+
+	var messages []*Message
+	for i := 0; i < 25; i++ {
+		messages = append(messages, &Message{ID: fmt.Sprintf("m%d", i), Type: "user.create"})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	res, _ := p.SendMessageBulk(ctx, messages, 1)
+	if len(res.Sent) != 0 || len(res.Failed) != 25 {
+		t.Fatalf("%d sent, %d failed, want every message reported as failed", len(res.Sent), len(res.Failed))
+	}
+}
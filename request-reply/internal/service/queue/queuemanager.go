@@ -2,6 +2,7 @@ package queue
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strconv"
 
@@ -25,7 +26,7 @@ func (qm *QueueManager) CrateStandartQueue(ctx context.Context, name string, vis
 		QueueName: aws.String(name), 
 		Attributes: map[string]string{
 			"VisibilityTimeout": strconv.Itoa(visibilityTimeout), 
-			"MessageRetationPeriot": strconv.Itoa(messageRetantion), 
+			"MessageRetentionPeriod": strconv.Itoa(messageRetantion), 
 			"ReceiveMessageWaitTimeSeconds": "20"}}
 
 	out,err:=qm.client.CreateQueue(ctx,in)
@@ -44,13 +45,13 @@ func (qm *QueueManager) CreateFIFOQueue(ctx context.Context, name string, visibi
 
 	attr:= map[string]string{
 			"FifoQueue":"true",
-			"VisibiltyTimeout":strconv.Itoa(visibiltyTimeout),
+			"VisibilityTimeout":strconv.Itoa(visibiltyTimeout),
 			"ReceiveMessageWaitTimeSeconds": "20",
 		}
 	
 
 	if contentBasedDedup{
-		attr["ContentBasedDepublication"]="true"
+		attr["ContentBasedDeduplication"]="true"
 	}
 
 	in:=&sqs.CreateQueueInput{
@@ -123,4 +124,40 @@ func (qm *QueueManager) GetQueueARN(ctx context.Context, queueURL string)(string
     return res.Attributes["QueueArn"], nil
 }
 
+// RedrivePolicy is the dead letter setup of a queue
+type RedrivePolicy struct {
+	DeadLetterTargetArn string
+	MaxReceiveCount     int
+}
+
+// GetRedrivePolicy returns nil when the queue has no dead letter queue
+func (qm *QueueManager) GetRedrivePolicy(ctx context.Context, queueURL string) (*RedrivePolicy, error) {
+	in := &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(queueURL),
+		AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameRedrivePolicy},
+	}
+
+	res, err := qm.client.GetQueueAttributes(ctx, in)
+	if err != nil {
+		return nil, fmt.Errorf("getting redrive policy: %w", err)
+	}
+	raw := res.Attributes[string(types.QueueAttributeNameRedrivePolicy)]
+	if raw == "" {
+		return nil, nil
+	}
 
+	// maxReceiveCount comes back as a number or a
+	// string depending on how the policy was set
+	var p struct {
+		DeadLetterTargetArn string      `json:"deadLetterTargetArn"`
+		MaxReceiveCount     json.Number `json:"maxReceiveCount"`
+	}
+	if err := json.Unmarshal([]byte(raw), &p); err != nil {
+		return nil, fmt.Errorf("decoding redrive policy: %w", err)
+	}
+	n, err := strconv.Atoi(p.MaxReceiveCount.String())
+	if err != nil {
+		return nil, fmt.Errorf("decoding redrive policy max receive count: %w", err)
+	}
+	return &RedrivePolicy{DeadLetterTargetArn: p.DeadLetterTargetArn, MaxReceiveCount: n}, nil
+}
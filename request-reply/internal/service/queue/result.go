@@ -0,0 +1,22 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Result is the output of a handler, handlers without
+// output return a nil result
+type Result struct {
+	ContentType string
+	Data        []byte
+}
+
+// JSONResult encodes v as an application/json result
+func JSONResult(v any) (*Result, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("converting result into json: %w", err)
+	}
+	return &Result{ContentType: "application/json", Data: data}, nil
+}
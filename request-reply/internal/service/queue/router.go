@@ -0,0 +1,52 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// Router dispatches messages to a handler per type, middlewares
+// added with Use wrap every route, the ones passed to Handle only
+// wrap that route
+type Router struct {
+	routes      map[string]Handler
+	middlewares []HandlerMiddleware
+	notFound    Handler
+}
+
+func NewRouter() *Router {
+	return &Router{
+		routes: make(map[string]Handler),
+		notFound: func(ctx context.Context, m *MessageConsumer) (*Result, error) {
+			slog.Info("Unknown message type", "type", m.Type)
+			return nil, Permanent(fmt.Errorf("no handler for message type %q", m.Type))
+		},
+	}
+}
+
+// Use adds middlewares around every route, call it before Handler
+func (r *Router) Use(mws ...HandlerMiddleware) {
+	r.middlewares = append(r.middlewares, mws...)
+}
+
+func (r *Router) Handle(msgType string, h Handler, mws ...HandlerMiddleware) {
+	r.routes[msgType] = Chain(h, mws...)
+}
+
+// NotFound replaces the handler of unknown types, by default
+// they fail permanently so their job doesn't pass as succeeded
+func (r *Router) NotFound(h Handler) {
+	r.notFound = h
+}
+
+// Handler returns the handler to pass to NewConsumer
+func (r *Router) Handler() Handler {
+	dispatch := func(ctx context.Context, m *MessageConsumer) (*Result, error) {
+		if h, ok := r.routes[m.Type]; ok {
+			return h(ctx, m)
+		}
+		return r.notFound(ctx, m)
+	}
+	return Chain(dispatch, r.middlewares...)
+}
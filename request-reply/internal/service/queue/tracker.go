@@ -0,0 +1,20 @@
+package queue
+
+import "context"
+
+// JobTracker records the lifecycle of the job behind a message
+// around every processing attempt of the consumer
+type JobTracker interface {
+	// Start is called before the handler runs and returns the attempt
+	// number, ErrJobFinished means the message must not be processed
+	Start(ctx context.Context, msg *MessageConsumer, workerID string) (int, error)
+	// Finish records the outcome of the attempt, handlerErr is nil
+	// on success and result is what the handler returned
+	Finish(ctx context.Context, msg *MessageConsumer, workerID string, attempt int, result *Result, handlerErr error) error
+}
+
+// QuarantineTracker is implemented by trackers that fail the job
+// of a message the consumer quarantined without processing it
+type QuarantineTracker interface {
+	Quarantined(ctx context.Context, jobID string, cause error) error
+}
@@ -0,0 +1,279 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/google/uuid"
+	"github.com/robfig/cron/v3"
+	"github.com/serdarozerr/request-reply/internal/models"
+	"github.com/serdarozerr/request-reply/internal/service/leader"
+	"github.com/serdarozerr/request-reply/internal/service/outbox"
+	"github.com/serdarozerr/request-reply/internal/service/queue"
+)
+
+var (
+	ErrInvalidCronJob = errors.New("invalid cron job")
+	// the job of the previous run is not finished yet
+	ErrCronJobRunning = errors.New("previous run of the cron job is still running")
+)
+
+// CronJob emits a job of Type on every tick of Schedule, a standard
+// five field cron expression or a descriptor like @daily, evaluated
+// in Timezone
+type CronJob struct {
+	tableName struct{} `pg:"cron_jobs"`
+
+	Name      string         `pg:"name,pk" json:"name"`
+	Type      string         `pg:"type" json:"type"`
+	Schedule  string         `pg:"schedule" json:"schedule"`
+	Timezone  string         `pg:"timezone" json:"timezone"`
+	Payload   map[string]any `pg:"payload,type:jsonb" json:"payload,omitempty"`
+	Paused    bool           `pg:"paused,use_zero" json:"paused"`
+	LastRunAt time.Time      `pg:"last_run_at" json:"last_run_at,omitzero"`
+	LastJobID string         `pg:"last_job_id" json:"last_job_id,omitempty"`
+	NextRunAt time.Time      `pg:"next_run_at" json:"next_run_at"`
+	CreatedAt time.Time      `pg:"created_at" json:"created_at"`
+	UpdatedAt time.Time      `pg:"updated_at" json:"updated_at"`
+}
+
+// next returns the first tick of the schedule after t
+func (c *CronJob) next(t time.Time) (time.Time, error) {
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: unknown timezone %q", ErrInvalidCronJob, c.Timezone)
+	}
+	sched, err := cron.ParseStandard(c.Schedule)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %v", ErrInvalidCronJob, err)
+	}
+	return sched.Next(t.In(loc)).UTC(), nil
+}
+
+// SaveCronJob creates or replaces the cron job with the same name,
+// the run history is kept
+func SaveCronJob(ctx context.Context, db *pg.DB, c *CronJob) error {
+	if c.Name == "" || c.Type == "" || c.Schedule == "" {
+		return fmt.Errorf("%w: name, type and schedule are required", ErrInvalidCronJob)
+	}
+	if c.Timezone == "" {
+		c.Timezone = "UTC"
+	}
+
+	now := time.Now().UTC()
+	next, err := c.next(now)
+	if err != nil {
+		return err
+	}
+	c.NextRunAt = next
+	c.CreatedAt = now
+	c.UpdatedAt = now
+
+	_, err = db.ModelContext(ctx, c).
+		OnConflict("(name) DO UPDATE").
+		Set("type = EXCLUDED.type").
+		Set("schedule = EXCLUDED.schedule").
+		Set("timezone = EXCLUDED.timezone").
+		Set("payload = EXCLUDED.payload").
+		Set("paused = EXCLUDED.paused").
+		Set("next_run_at = EXCLUDED.next_run_at").
+		Set("updated_at = EXCLUDED.updated_at").
+		Returning("*").
+		Insert()
+	return err
+}
+
+func GetCronJob(ctx context.Context, db orm.DB, name string) (*CronJob, error) {
+	c := new(CronJob)
+	err := db.ModelContext(ctx, c).Where("name = ?", name).Select()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func ListCronJobs(ctx context.Context, db orm.DB) ([]*CronJob, error) {
+	var jobs []*CronJob
+	err := db.ModelContext(ctx, &jobs).Order("name").Select()
+	return jobs, err
+}
+
+// DeleteCronJob reports whether a cron job was deleted
+func DeleteCronJob(ctx context.Context, db orm.DB, name string) (bool, error) {
+	res, err := db.ModelContext(ctx, (*CronJob)(nil)).Where("name = ?", name).Delete()
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// SetCronJobPaused pauses or resumes the cron job, a resumed job
+// runs on its next tick, the ones missed while paused are skipped
+func SetCronJobPaused(ctx context.Context, db *pg.DB, name string, paused bool) (*CronJob, error) {
+	var c *CronJob
+
+	err := db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		var err error
+		c, err = lockCronJob(ctx, tx, name)
+		if err != nil {
+			return err
+		}
+
+		c.Paused = paused
+		c.UpdatedAt = time.Now().UTC()
+		if !paused {
+			if c.NextRunAt, err = c.next(c.UpdatedAt); err != nil {
+				return err
+			}
+		}
+		_, err = tx.ModelContext(ctx, c).Column("paused", "next_run_at", "updated_at").WherePK().Update()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// TriggerCronJob runs the cron job now, outside of its schedule, and
+// returns the id of the emitted job. Paused jobs can be triggered
+func TriggerCronJob(ctx context.Context, db *pg.DB, name string) (string, error) {
+	var jobID string
+
+	err := db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		c, err := lockCronJob(ctx, tx, name)
+		if err != nil {
+			return err
+		}
+
+		running, err := lastRunActive(tx, c)
+		if err != nil {
+			return err
+		}
+		if running {
+			return ErrCronJobRunning
+		}
+
+		jobID, err = emit(tx, c)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ModelContext(ctx, c).Column("last_run_at", "last_job_id").WherePK().Update()
+		return err
+	})
+	return jobID, err
+}
+
+func lockCronJob(ctx context.Context, tx *pg.Tx, name string) (*CronJob, error) {
+	c := new(CronJob)
+	err := tx.ModelContext(ctx, c).Where("name = ?", name).For("UPDATE").Select()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// lastRunActive reports whether the job of the previous run is not finished
+func lastRunActive(tx *pg.Tx, c *CronJob) (bool, error) {
+	if c.LastJobID == "" {
+		return false, nil
+	}
+	job, err := models.GetJob(tx, c.LastJobID)
+	if errors.Is(err, pg.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("reading last job of cron job %s: %w", c.Name, err)
+	}
+	return !models.IsTerminal(job.Status), nil
+}
+
+// emit inserts a job for the cron job with its outbox message
+func emit(tx *pg.Tx, c *CronJob) (string, error) {
+	now := time.Now().UTC()
+	msg := &queue.Message{
+		Version:   "1",
+		ID:        uuid.NewString(),
+		Type:      c.Type,
+		Payload:   c.Payload,
+		Timestamp: now,
+	}
+
+	job := models.NewJob(msg.ID, msg.Type, "")
+	job.Submitter = "cron:" + c.Name
+	if err := models.InsertJob(tx, job); err != nil {
+		return "", fmt.Errorf("inserting job: %w", err)
+	}
+	if err := outbox.Enqueue(tx, msg, 0); err != nil {
+		return "", err
+	}
+
+	c.LastRunAt = now
+	c.LastJobID = msg.ID
+	return msg.ID, nil
+}
+
+// fireCron emits a job for every cron job whose tick has come, a
+// tick is skipped while the previous run is still active. Returns
+// the number of handled cron jobs
+func (s *Scheduler) fireCron(ctx context.Context) (int, error) {
+	var claimed int
+
+	err := s.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		if err := leader.Check(ctx, tx); err != nil {
+			return err
+		}
+
+		var due []*CronJob
+		err := tx.ModelContext(ctx, &due).
+			Where("NOT paused").
+			Where("next_run_at <= now()").
+			Order("next_run_at").
+			Limit(s.cfg.BatchSize).
+			For("UPDATE SKIP LOCKED").
+			Select()
+		if err != nil {
+			return fmt.Errorf("claiming cron jobs: %w", err)
+		}
+		claimed = len(due)
+
+		for _, c := range due {
+			running, err := lastRunActive(tx, c)
+			if err != nil {
+				return err
+			}
+
+			if running {
+				slog.Warn("skipping cron run, previous run is still active", "cron", c.Name, "last_job_id", c.LastJobID)
+			} else {
+				jobID, err := emit(tx, c)
+				if err != nil {
+					return fmt.Errorf("running cron job %s: %w", c.Name, err)
+				}
+				slog.Info("cron job emitted", "cron", c.Name, "job_id", jobID)
+			}
+
+			// ticks missed while no scheduler was active are not caught up
+			c.NextRunAt, err = c.next(time.Now())
+			if err != nil {
+				return err
+			}
+			c.UpdatedAt = time.Now().UTC()
+			_, err = tx.ModelContext(ctx, c).
+				Column("last_run_at", "last_job_id", "next_run_at", "updated_at").
+				WherePK().
+				Update()
+			if err != nil {
+				return fmt.Errorf("updating cron job %s: %w", c.Name, err)
+			}
+		}
+		return nil
+	})
+
+	return claimed, err
+}
@@ -0,0 +1,66 @@
+package scheduler
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/serdarozerr/request-reply/internal/models"
+	"github.com/serdarozerr/request-reply/internal/service/outbox"
+	"github.com/serdarozerr/request-reply/internal/service/queue"
+)
+
+// SQS caps DelaySeconds at 900, messages due later
+// wait in the scheduled_jobs table
+const maxNativeDelay = 15 * time.Minute
+
+// record is a message waiting for its run_at
+type record struct {
+	tableName struct{} `pg:"scheduled_jobs"`
+
+	ID        int64          `pg:"id,pk"`
+	JobID     string         `pg:"job_id"`
+	Message   *queue.Message `pg:"message,type:jsonb"`
+	RunAt     time.Time      `pg:"run_at"`
+	CreatedAt time.Time      `pg:"created_at"`
+}
+
+// Schedule inserts the job and makes its message run at runAt. Jobs
+// due within the SQS delay limit go to the outbox with a delay, later
+// ones are kept as scheduled until the scheduler enqueues them. Pass
+// a transaction so the job and its message are committed together
+func Schedule(db orm.DB, job *models.Job, m *queue.Message, runAt time.Time) error {
+	job.RunAt = runAt.UTC()
+
+	delay := time.Until(runAt)
+	if delay <= maxNativeDelay {
+		if err := models.InsertJob(db, job); err != nil {
+			return fmt.Errorf("inserting job: %w", err)
+		}
+		return outbox.Enqueue(db, m, delaySeconds(delay))
+	}
+
+	job.Status = models.JobStatusScheduled
+	if err := models.InsertJob(db, job); err != nil {
+		return fmt.Errorf("inserting job: %w", err)
+	}
+
+	_, err := db.Model(&record{
+		JobID:     job.JobID,
+		Message:   m,
+		RunAt:     job.RunAt,
+		CreatedAt: time.Now().UTC(),
+	}).Insert()
+	if err != nil {
+		return fmt.Errorf("inserting scheduled job: %w", err)
+	}
+	return nil
+}
+
+func delaySeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return min(int(math.Ceil(d.Seconds())), int(maxNativeDelay.Seconds()))
+}
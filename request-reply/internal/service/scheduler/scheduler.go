@@ -0,0 +1,126 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/serdarozerr/request-reply/internal/models"
+	"github.com/serdarozerr/request-reply/internal/service/leader"
+	"github.com/serdarozerr/request-reply/internal/service/outbox"
+)
+
+type Config struct {
+	// wait between polls for due jobs
+	PollInterval time.Duration
+	// jobs moved to the outbox per transaction
+	BatchSize int
+}
+
+// Scheduler moves scheduled jobs to the outbox once they are within
+// the SQS delay limit of their run_at, the rest of the wait is done
+// by SQS, and emits the jobs of the cron jobs
+type Scheduler struct {
+	db  *pg.DB
+	cfg Config
+}
+
+func New(db *pg.DB, cfg Config) *Scheduler {
+
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 10 * time.Second
+	}
+
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+
+	return &Scheduler{db: db, cfg: cfg}
+}
+
+// Run enqueues due jobs and fires cron jobs until ctx is done, run
+// it as the OnElected duty of a leader.Elector so only one instance
+// is active, the writes are fenced with the lease in ctx
+func (s *Scheduler) Run(ctx context.Context) error {
+	for {
+		n, err := s.enqueueDue(ctx)
+		if err != nil {
+			slog.Error("enqueuing scheduled jobs", "error", err)
+		}
+
+		fired, cronErr := s.fireCron(ctx)
+		if cronErr != nil {
+			slog.Error("running cron jobs", "error", cronErr)
+		}
+
+		if errors.Is(err, leader.ErrNotLeader) || errors.Is(cronErr, leader.ErrNotLeader) {
+			return leader.ErrNotLeader
+		}
+
+		// keep draining while full batches come back
+		if (err == nil && n == s.cfg.BatchSize) || (cronErr == nil && fired == s.cfg.BatchSize) {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.cfg.PollInterval):
+		}
+	}
+}
+
+// enqueueDue moves a batch of jobs due within the SQS delay limit to
+// the outbox, returns the number of handled rows
+func (s *Scheduler) enqueueDue(ctx context.Context) (int, error) {
+	var claimed int
+
+	err := s.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		if err := leader.Check(ctx, tx); err != nil {
+			return err
+		}
+
+		var records []*record
+		err := tx.ModelContext(ctx, &records).
+			Where("run_at <= ?", time.Now().UTC().Add(maxNativeDelay)).
+			Order("run_at").
+			Limit(s.cfg.BatchSize).
+			For("UPDATE SKIP LOCKED").
+			Select()
+		if err != nil {
+			return fmt.Errorf("claiming scheduled jobs: %w", err)
+		}
+		claimed = len(records)
+
+		for _, rec := range records {
+			job := new(models.Job)
+			err := tx.ModelContext(ctx, job).Where("job_id = ?", rec.JobID).For("UPDATE").Select()
+			if err != nil {
+				return fmt.Errorf("reading job %s: %w", rec.JobID, err)
+			}
+
+			if _, err := tx.ModelContext(ctx, rec).WherePK().Delete(); err != nil {
+				return fmt.Errorf("deleting scheduled job %s: %w", rec.JobID, err)
+			}
+
+			// cancelled while it was waiting
+			if err := models.Transition(job, models.JobStatusQueued); errors.Is(err, models.ErrInvalidTransition) {
+				slog.Info("dropping scheduled job", "job_id", job.JobID, "status", job.Status)
+				continue
+			}
+			if err := models.UpdateJob(tx, job); err != nil {
+				return fmt.Errorf("updating job %s: %w", rec.JobID, err)
+			}
+			if err := outbox.Enqueue(tx, rec.Message, delaySeconds(time.Until(rec.RunAt))); err != nil {
+				return err
+			}
+			slog.Info("scheduled job enqueued", "job_id", job.JobID, "run_at", rec.RunAt)
+		}
+		return nil
+	})
+
+	return claimed, err
+}
@@ -0,0 +1,331 @@
+package workflow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/serdarozerr/request-reply/internal/models"
+	"github.com/serdarozerr/request-reply/internal/service/outbox"
+	"github.com/serdarozerr/request-reply/internal/service/queue"
+)
+
+// results up to this size are kept with the step
+// and passed on to its dependents
+const maxPassedResult = 64 * 1024
+
+// StepFinished records the outcome of a step job and enqueues what
+// becomes ready, call it in the transaction that finishes the job.
+// Jobs that are not workflow steps are ignored
+func StepFinished(ctx context.Context, tx *pg.Tx, job *models.Job, result *queue.Result) error {
+	var status string
+	switch job.Status {
+	case models.JobStatusSucceeded:
+		status = StepSucceeded
+	case models.JobStatusFailed, models.JobStatusDead:
+		status = StepFailed
+	case models.JobStatusCancelled:
+		// a step cancelled on its own didn't do its work, the
+		// failure policy decides how the workflow goes on
+		status = StepFailed
+	default:
+		return nil
+	}
+
+	wf, err := lockWorkflow(ctx, tx, job.ParentID)
+	if errors.Is(err, pg.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var step *Step
+	for _, s := range wf.Steps {
+		if s.JobID == job.JobID {
+			step = s
+		}
+	}
+	// not a step, or a redelivery of a finished one
+	if step == nil || step.finished() {
+		return nil
+	}
+
+	step.Status = status
+	step.FinishedAt = time.Now().UTC()
+	if status == StepSucceeded {
+		step.Result = passedResult(result)
+	}
+	if err := updateStep(ctx, tx, step); err != nil {
+		return err
+	}
+	slog.Info("workflow step finished", "workflow_id", wf.WorkflowID, "step", step.Name, "kind", step.Kind, "status", step.Status)
+
+	if wf.finished() {
+		return nil
+	}
+	return advance(ctx, tx, wf)
+}
+
+// Cancelled stops the workflow whose parent job was cancelled, steps
+// that are not enqueued yet are skipped. It is a no-op for other jobs
+func Cancelled(ctx context.Context, tx *pg.Tx, jobID string) error {
+	wf, err := lockWorkflow(ctx, tx, jobID)
+	if errors.Is(err, pg.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if wf.finished() {
+		return nil
+	}
+	return finish(ctx, tx, wf, StatusCancelled)
+}
+
+func lockWorkflow(ctx context.Context, tx *pg.Tx, workflowID string) (*Workflow, error) {
+	if workflowID == "" {
+		return nil, pg.ErrNoRows
+	}
+
+	wf := new(Workflow)
+	err := tx.ModelContext(ctx, wf).Where("workflow_id = ?", workflowID).For("UPDATE").Select()
+	if err != nil {
+		return nil, err
+	}
+	err = tx.ModelContext(ctx, &wf.Steps).Where("workflow_id = ?", workflowID).Order("id").Select()
+	if err != nil {
+		return nil, fmt.Errorf("reading workflow steps: %w", err)
+	}
+	return wf, nil
+}
+
+// advance enqueues the steps whose dependencies are done, and
+// settles the workflow once nothing is in flight anymore
+func advance(ctx context.Context, tx *pg.Tx, wf *Workflow) error {
+	steps := make(map[string]*Step)
+	compensations := make(map[string]*Step)
+	failed, inFlight := false, false
+	for _, s := range wf.Steps {
+		if s.Kind == kindCompensation {
+			compensations[s.Name] = s
+			continue
+		}
+		steps[s.Name] = s
+		failed = failed || s.Status == StepFailed
+	}
+
+	if wf.Status == StatusRunning {
+		startNew := !failed || wf.FailurePolicy == PolicyContinue
+
+		for _, s := range wf.Steps {
+			if s.Kind != kindStep || s.Status != StepPending {
+				continue
+			}
+			if !startNew {
+				s.Status = StepSkipped
+				if err := updateStep(ctx, tx, s); err != nil {
+					return err
+				}
+				continue
+			}
+			if ready(s, steps, wf.FailurePolicy) {
+				if err := enqueue(ctx, tx, wf, s, upstream(s, steps)); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, s := range steps {
+			inFlight = inFlight || s.Status == StepEnqueued
+		}
+		if inFlight {
+			return nil
+		}
+
+		switch {
+		case !failed:
+			return finish(ctx, tx, wf, StatusSucceeded)
+		case wf.FailurePolicy != PolicyCompensate:
+			return finish(ctx, tx, wf, StatusFailed)
+		}
+
+		if err := addRegisteredCompensations(ctx, tx, wf); err != nil {
+			return err
+		}
+		for _, c := range wf.Steps {
+			if c.Kind == kindCompensation {
+				compensations[c.Name] = c
+			}
+		}
+
+		wf.Status = StatusCompensating
+		wf.UpdatedAt = time.Now().UTC()
+		if _, err := tx.ModelContext(ctx, wf).Column("status", "updated_at").WherePK().Update(); err != nil {
+			return fmt.Errorf("updating workflow: %w", err)
+		}
+		slog.Info("compensating workflow", "workflow_id", wf.WorkflowID)
+	}
+
+	// compensations run one at a time, the last succeeded step first
+	var next *Step
+	for name, c := range compensations {
+		switch {
+		case c.Status == StepEnqueued:
+			return nil
+		case c.Status == StepFailed:
+			// the saga is stuck, see ListStuckSagas
+			slog.Error("compensation failed", "workflow_id", wf.WorkflowID, "step", name, "job_id", c.JobID)
+			return finish(ctx, tx, wf, StatusCompensationFailed)
+		case c.Status != StepPending || steps[name].Status != StepSucceeded:
+			continue
+		}
+		if next == nil || steps[name].FinishedAt.After(steps[next.Name].FinishedAt) {
+			next = c
+		}
+	}
+	if next == nil {
+		return finish(ctx, tx, wf, StatusCompensated)
+	}
+
+	done := steps[next.Name]
+	return enqueue(ctx, tx, wf, next, map[string]any{
+		"compensates": map[string]any{"job_id": done.JobID, "result": done.Result},
+	})
+}
+
+// ready reports whether the dependencies of the step allow it to run,
+// under the continue policy failed dependencies count as done
+func ready(s *Step, steps map[string]*Step, policy string) bool {
+	for _, dep := range s.DependsOn {
+		switch steps[dep].Status {
+		case StepSucceeded:
+		case StepFailed, StepSkipped:
+			if policy != PolicyContinue {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// upstream is what a step gets from its dependencies
+func upstream(s *Step, steps map[string]*Step) map[string]any {
+	if len(s.DependsOn) == 0 {
+		return nil
+	}
+	results := make(map[string]any, len(s.DependsOn))
+	for _, dep := range s.DependsOn {
+		d := steps[dep]
+		results[dep] = map[string]any{"job_id": d.JobID, "status": d.Status, "result": d.Result}
+	}
+	return map[string]any{"upstream": results}
+}
+
+// enqueue creates the job of the step and writes its message,
+// with extra merged into the payload, to the outbox
+func enqueue(ctx context.Context, tx *pg.Tx, wf *Workflow, s *Step, extra map[string]any) error {
+	msg := *s.Message
+	msg.Payload = make(map[string]any, len(s.Message.Payload)+len(extra))
+	for k, v := range s.Message.Payload {
+		msg.Payload[k] = v
+	}
+	for k, v := range extra {
+		msg.Payload[k] = v
+	}
+	msg.Timestamp = time.Now().UTC()
+
+	if err := models.InsertJob(tx, models.NewJob(s.JobID, s.Type, wf.WorkflowID)); err != nil {
+		return fmt.Errorf("inserting job of step %s: %w", s.Name, err)
+	}
+	if err := outbox.Enqueue(tx, &msg, 0); err != nil {
+		return err
+	}
+
+	s.Status = StepEnqueued
+	s.EnqueuedAt = msg.Timestamp
+	return updateStep(ctx, tx, s)
+}
+
+// finish settles the workflow, skips what didn't run and
+// finishes the parent job
+func finish(ctx context.Context, tx *pg.Tx, wf *Workflow, status string) error {
+	now := time.Now().UTC()
+	wf.Status = status
+	wf.UpdatedAt = now
+	wf.FinishedAt = now
+	if _, err := tx.ModelContext(ctx, wf).Column("status", "updated_at", "finished_at").WherePK().Update(); err != nil {
+		return fmt.Errorf("updating workflow: %w", err)
+	}
+
+	for _, s := range wf.Steps {
+		if s.Status != StepPending {
+			continue
+		}
+		s.Status = StepSkipped
+		if err := updateStep(ctx, tx, s); err != nil {
+			return err
+		}
+	}
+	slog.Info("workflow finished", "workflow_id", wf.WorkflowID, "status", status)
+
+	// a cancelled parent job is already finished
+	if status == StatusCancelled {
+		return nil
+	}
+
+	parent := new(models.Job)
+	err := tx.ModelContext(ctx, parent).Where("job_id = ?", wf.WorkflowID).For("UPDATE").Select()
+	if err != nil {
+		return fmt.Errorf("reading workflow job: %w", err)
+	}
+	if models.IsTerminal(parent.Status) {
+		return nil
+	}
+
+	jobStatus := models.JobStatusSucceeded
+	if status != StatusSucceeded {
+		jobStatus = models.JobStatusFailed
+		parent.LastError = "workflow " + status
+	}
+	if err := models.Transition(parent, jobStatus); err != nil {
+		return err
+	}
+	return models.UpdateJob(tx, parent)
+}
+
+func updateStep(ctx context.Context, tx *pg.Tx, s *Step) error {
+	_, err := tx.ModelContext(ctx, s).
+		Column("status", "result", "enqueued_at", "finished_at").
+		WherePK().
+		Update()
+	if err != nil {
+		return fmt.Errorf("updating step %s: %w", s.Name, err)
+	}
+	return nil
+}
+
+// passedResult decodes a small JSON result, other
+// results stay with the job only
+func passedResult(res *queue.Result) any {
+	if res == nil || len(res.Data) > maxPassedResult {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(res.ContentType)
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return nil
+	}
+	var v any
+	if err := json.Unmarshal(res.Data, &v); err != nil {
+		return nil
+	}
+	return v
+}
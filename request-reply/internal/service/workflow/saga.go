@@ -0,0 +1,144 @@
+package workflow
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+)
+
+// Compensation undoes a step type, Payload builds the payload of the
+// compensating job from the payload and result of the succeeded step.
+// Sensitive fields of the step payload are still encrypted
+type Compensation struct {
+	Type    string
+	Payload func(payload map[string]any, result any) map[string]any
+}
+
+var (
+	registryMu    sync.RWMutex
+	compensations = make(map[string]Compensation)
+)
+
+// RegisterCompensation makes steps of stepType compensatable without a
+// compensate block in the definition. Register them in the process
+// that runs the consumer, compensations are built there
+func RegisterCompensation(stepType string, c Compensation) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	compensations[stepType] = c
+}
+
+func registeredCompensation(stepType string) (Compensation, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	c, ok := compensations[stepType]
+	return c, ok
+}
+
+// CompensationProgress counts the compensations of a saga
+type CompensationProgress struct {
+	Total     int `json:"total"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	Running   int `json:"running"`
+	Pending   int `json:"pending"`
+}
+
+func (w *Workflow) compensationProgress() *CompensationProgress {
+	p := &CompensationProgress{}
+	for _, s := range w.Steps {
+		if s.Kind != kindCompensation || s.Status == StepSkipped {
+			continue
+		}
+		p.Total++
+		switch s.Status {
+		case StepSucceeded:
+			p.Succeeded++
+		case StepFailed:
+			p.Failed++
+		case StepEnqueued:
+			p.Running++
+		default:
+			p.Pending++
+		}
+	}
+	if p.Total == 0 {
+		return nil
+	}
+	return p
+}
+
+// addRegisteredCompensations creates the compensations of the succeeded
+// steps that have none in the definition but a registered one
+func addRegisteredCompensations(ctx context.Context, tx *pg.Tx, wf *Workflow) error {
+	defined := make(map[string]bool)
+	for _, s := range wf.Steps {
+		if s.Kind == kindCompensation {
+			defined[s.Name] = true
+		}
+	}
+
+	var added []*Step
+	for _, s := range wf.Steps {
+		if s.Kind != kindStep || s.Status != StepSucceeded || defined[s.Name] {
+			continue
+		}
+		c, ok := registeredCompensation(s.Type)
+		if !ok {
+			continue
+		}
+
+		var payload map[string]any
+		if c.Payload != nil {
+			payload = c.Payload(s.Message.Payload, s.Result)
+		}
+		comp, err := newStep(ctx, nil, wf.WorkflowID, s.Name, kindCompensation, c.Type, payload, nil)
+		if err != nil {
+			return err
+		}
+		added = append(added, comp)
+	}
+
+	if len(added) == 0 {
+		return nil
+	}
+	if _, err := tx.ModelContext(ctx, &added).Insert(); err != nil {
+		return fmt.Errorf("inserting compensations: %w", err)
+	}
+	wf.Steps = append(wf.Steps, added...)
+	return nil
+}
+
+// ListStuckSagas returns the sagas that need a look, the ones whose
+// compensation failed and the ones waiting longer than olderThan
+// for a compensation to finish
+func ListStuckSagas(ctx context.Context, db orm.DB, olderThan time.Duration) ([]*Workflow, error) {
+	var workflows []*Workflow
+	err := db.ModelContext(ctx, &workflows).
+		Relation("Steps", func(q *orm.Query) (*orm.Query, error) {
+			return q.Order("id"), nil
+		}).
+		WhereGroup(func(q *orm.Query) (*orm.Query, error) {
+			q = q.Where("workflow.status = ?", StatusCompensationFailed).
+				WhereOr(`workflow.status = ? AND EXISTS (
+					SELECT 1 FROM workflow_steps s
+					WHERE s.workflow_id = workflow.workflow_id
+					AND s.kind = ? AND s.status = ? AND s.enqueued_at < ?)`,
+					StatusCompensating, kindCompensation, StepEnqueued, time.Now().UTC().Add(-olderThan))
+			return q, nil
+		}).
+		Order("workflow.updated_at").
+		Limit(500).
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	for _, wf := range workflows {
+		wf.Compensation = wf.compensationProgress()
+	}
+	return workflows, nil
+}
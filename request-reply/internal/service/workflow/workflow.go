@@ -0,0 +1,307 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/google/uuid"
+	"github.com/serdarozerr/request-reply/internal/models"
+	"github.com/serdarozerr/request-reply/internal/service/encryption"
+	"github.com/serdarozerr/request-reply/internal/service/queue"
+)
+
+// job type of the parent job of a workflow
+const JobType = "workflow"
+
+const maxSteps = 100
+
+// what happens to the rest of the workflow when a step fails
+const (
+	// no new steps are started, the workflow fails
+	PolicyAbort = "abort"
+	// the dependents of the failed step still run
+	PolicyContinue = "continue"
+	// no new steps are started and the compensations of the
+	// succeeded steps run in reverse order, see RegisterCompensation
+	PolicyCompensate = "compensate"
+)
+
+const (
+	StatusRunning            = "running"
+	StatusSucceeded          = "succeeded"
+	StatusFailed             = "failed"
+	StatusCompensating       = "compensating"
+	StatusCompensated        = "compensated"
+	StatusCompensationFailed = "compensation_failed"
+	StatusCancelled          = "cancelled"
+)
+
+const (
+	StepPending   = "pending"
+	StepEnqueued  = "enqueued"
+	StepSucceeded = "succeeded"
+	StepFailed    = "failed"
+	StepSkipped   = "skipped"
+)
+
+const (
+	kindStep         = "step"
+	kindCompensation = "compensation"
+)
+
+var ErrInvalidDefinition = errors.New("invalid workflow definition")
+
+// Definition is a workflow submission, steps form a DAG
+// through DependsOn
+type Definition struct {
+	FailurePolicy string           `json:"failure_policy"`
+	Steps         []StepDefinition `json:"steps"`
+}
+
+type StepDefinition struct {
+	Name      string         `json:"name"`
+	Type      string         `json:"type"`
+	Payload   map[string]any `json:"payload"`
+	DependsOn []string       `json:"depends_on"`
+	// payload fields encrypted until the step's handler runs
+	Sensitive []string `json:"sensitive"`
+	// optional, undoes the step under the compensate policy
+	Compensate *CompensationDefinition `json:"compensate"`
+}
+
+type CompensationDefinition struct {
+	Type      string         `json:"type"`
+	Payload   map[string]any `json:"payload"`
+	Sensitive []string       `json:"sensitive"`
+}
+
+type Workflow struct {
+	tableName struct{} `pg:"workflows"`
+
+	WorkflowID    string    `pg:"workflow_id,pk" json:"workflow_id"`
+	FailurePolicy string    `pg:"failure_policy" json:"failure_policy"`
+	Status        string    `pg:"status" json:"status"`
+	CreatedAt     time.Time `pg:"created_at" json:"created_at"`
+	UpdatedAt     time.Time `pg:"updated_at" json:"updated_at"`
+	FinishedAt    time.Time `pg:"finished_at" json:"finished_at,omitzero"`
+
+	Steps []*Step `pg:"rel:has-many,join_fk:workflow_id" json:"steps"`
+	// set when the workflow has compensations
+	Compensation *CompensationProgress `pg:"-" json:"compensation,omitempty"`
+}
+
+func (w *Workflow) finished() bool {
+	switch w.Status {
+	case StatusRunning, StatusCompensating:
+		return false
+	}
+	return true
+}
+
+// Step is a step of the workflow or the compensation of one, its
+// message is built at submission and enqueued once the step is ready
+type Step struct {
+	tableName struct{} `pg:"workflow_steps"`
+
+	ID         int64          `pg:"id,pk" json:"-"`
+	WorkflowID string         `pg:"workflow_id" json:"-"`
+	Name       string         `pg:"name" json:"name"`
+	Kind       string         `pg:"kind" json:"kind"`
+	Type       string         `pg:"type" json:"type"`
+	DependsOn  []string       `pg:"depends_on,type:jsonb" json:"depends_on,omitempty"`
+	Message    *queue.Message `pg:"message,type:jsonb" json:"-"`
+	JobID      string         `pg:"job_id" json:"job_id"`
+	Status     string         `pg:"status" json:"status"`
+	Result     any            `pg:"result,type:jsonb" json:"result,omitempty"`
+	CreatedAt  time.Time      `pg:"created_at" json:"created_at"`
+	EnqueuedAt time.Time      `pg:"enqueued_at" json:"enqueued_at,omitzero"`
+	FinishedAt time.Time      `pg:"finished_at" json:"finished_at,omitzero"`
+}
+
+func (s *Step) finished() bool {
+	return s.Status == StepSucceeded || s.Status == StepFailed || s.Status == StepSkipped
+}
+
+// Validate checks the names, dependencies and that the steps
+// don't form a cycle
+func (d *Definition) Validate() error {
+	switch d.FailurePolicy {
+	case "":
+		d.FailurePolicy = PolicyAbort
+	case PolicyAbort, PolicyContinue, PolicyCompensate:
+	default:
+		return fmt.Errorf("%w: unknown failure policy %q", ErrInvalidDefinition, d.FailurePolicy)
+	}
+
+	if len(d.Steps) == 0 || len(d.Steps) > maxSteps {
+		return fmt.Errorf("%w: a workflow has 1 to %d steps", ErrInvalidDefinition, maxSteps)
+	}
+
+	deps := make(map[string][]string, len(d.Steps))
+	for _, s := range d.Steps {
+		if s.Name == "" || s.Type == "" {
+			return fmt.Errorf("%w: every step needs a name and a type", ErrInvalidDefinition)
+		}
+		if _, ok := deps[s.Name]; ok {
+			return fmt.Errorf("%w: step %q is defined twice", ErrInvalidDefinition, s.Name)
+		}
+		if s.Compensate != nil && s.Compensate.Type == "" {
+			return fmt.Errorf("%w: compensation of step %q has no type", ErrInvalidDefinition, s.Name)
+		}
+		deps[s.Name] = s.DependsOn
+	}
+
+	for name, ds := range deps {
+		for _, dep := range ds {
+			if _, ok := deps[dep]; !ok {
+				return fmt.Errorf("%w: step %q depends on unknown step %q", ErrInvalidDefinition, name, dep)
+			}
+		}
+	}
+
+	// a step is removed once all of its dependencies are,
+	// whatever is left over sits on a cycle
+	done := make(map[string]bool, len(deps))
+	for progress := true; progress; {
+		progress = false
+		for name, ds := range deps {
+			if done[name] {
+				continue
+			}
+			ready := true
+			for _, dep := range ds {
+				ready = ready && done[dep]
+			}
+			if ready {
+				done[name] = true
+				progress = true
+			}
+		}
+	}
+	if len(done) != len(deps) {
+		return fmt.Errorf("%w: steps depend on each other in a cycle", ErrInvalidDefinition)
+	}
+	return nil
+}
+
+// Submit stores the workflow with a parent job and enqueues the
+// steps without dependencies, the id of the parent job is the
+// workflow id
+func Submit(ctx context.Context, db *pg.DB, kp encryption.KeyProvider, def *Definition, submitter string) (*Workflow, error) {
+	if err := def.Validate(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	wf := &Workflow{
+		WorkflowID:    uuid.NewString(),
+		FailurePolicy: def.FailurePolicy,
+		Status:        StatusRunning,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+
+	for _, sd := range def.Steps {
+		step, err := newStep(ctx, kp, wf.WorkflowID, sd.Name, kindStep, sd.Type, sd.Payload, sd.Sensitive)
+		if err != nil {
+			return nil, err
+		}
+		step.DependsOn = sd.DependsOn
+		if step.DependsOn == nil {
+			step.DependsOn = []string{}
+		}
+		wf.Steps = append(wf.Steps, step)
+
+		if sd.Compensate == nil {
+			continue
+		}
+		comp, err := newStep(ctx, kp, wf.WorkflowID, sd.Name, kindCompensation, sd.Compensate.Type, sd.Compensate.Payload, sd.Compensate.Sensitive)
+		if err != nil {
+			return nil, err
+		}
+		wf.Steps = append(wf.Steps, comp)
+	}
+
+	err := db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		// the parent job runs for as long as the workflow does
+		parent := models.NewJob(wf.WorkflowID, JobType, "")
+		parent.Submitter = submitter
+		for _, status := range []string{models.JobStatusReceived, models.JobStatusRunning} {
+			if err := models.Transition(parent, status); err != nil {
+				return err
+			}
+		}
+		if err := models.InsertJob(tx, parent); err != nil {
+			return fmt.Errorf("inserting workflow job: %w", err)
+		}
+
+		if _, err := tx.ModelContext(ctx, wf).Insert(); err != nil {
+			return fmt.Errorf("inserting workflow: %w", err)
+		}
+		if _, err := tx.ModelContext(ctx, &wf.Steps).Insert(); err != nil {
+			return fmt.Errorf("inserting workflow steps: %w", err)
+		}
+		return advance(ctx, tx, wf)
+	})
+	if err != nil {
+		return nil, err
+	}
+	wf.Compensation = wf.compensationProgress()
+	return wf, nil
+}
+
+func newStep(ctx context.Context, kp encryption.KeyProvider, workflowID, name, kind, stepType string, payload map[string]any, sensitive []string) (*Step, error) {
+	if payload == nil {
+		payload = map[string]any{}
+	}
+
+	msg := &queue.Message{
+		Version: "1",
+		ID:      uuid.NewString(),
+		Type:    stepType,
+		Payload: payload,
+	}
+
+	if len(sensitive) > 0 {
+		if kp == nil {
+			return nil, fmt.Errorf("step %s has sensitive fields but no key provider is configured", name)
+		}
+		var err error
+		msg.Encryption, err = encryption.Seal(ctx, kp, msg.ID, msg.Payload, sensitive)
+		if err != nil {
+			return nil, fmt.Errorf("encrypting step %s: %w", name, err)
+		}
+	}
+
+	return &Step{
+		WorkflowID: workflowID,
+		Name:       name,
+		Kind:       kind,
+		Type:       stepType,
+		Message:    msg,
+		JobID:      msg.ID,
+		Status:     StepPending,
+		CreatedAt:  time.Now().UTC(),
+	}, nil
+}
+
+// Get returns the workflow with its steps, pg.ErrNoRows when there
+// is none with the id
+func Get(ctx context.Context, db orm.DB, workflowID string) (*Workflow, error) {
+	wf := new(Workflow)
+	err := db.ModelContext(ctx, wf).
+		Relation("Steps", func(q *orm.Query) (*orm.Query, error) {
+			return q.Order("id"), nil
+		}).
+		Where("workflow.workflow_id = ?", workflowID).
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	wf.Compensation = wf.compensationProgress()
+	return wf, nil
+}
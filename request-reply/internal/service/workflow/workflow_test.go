@@ -0,0 +1,59 @@
+package workflow
+
+import (
+	"errors"
+	"testing"
+)
+
+func step(name string, deps ...string) StepDefinition {
+	return StepDefinition{Name: name, Type: "user.create", DependsOn: deps}
+}
+
+func TestDefinitionValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		steps   []StepDefinition
+		wantErr bool
+	}{
+		{"single step", []StepDefinition{step("a")}, false},
+		{"diamond", []StepDefinition{step("a"), step("b", "a"), step("c", "a"), step("d", "b", "c")}, false},
+		{"dependency listed first", []StepDefinition{step("b", "a"), step("a")}, false},
+		{"no steps", nil, true},
+		{"self dependency", []StepDefinition{step("a", "a")}, true},
+		{"two step cycle", []StepDefinition{step("a", "b"), step("b", "a")}, true},
+		{"cycle behind a valid step", []StepDefinition{step("a"), step("b", "a", "d"), step("c", "b"), step("d", "c")}, true},
+		{"unknown dependency", []StepDefinition{step("a", "missing")}, true},
+		{"duplicate name", []StepDefinition{step("a"), step("a")}, true},
+		{"step without type", []StepDefinition{{Name: "a"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Definition{Steps: tt.steps}
+			err := d.Validate()
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidDefinition) {
+					t.Fatalf("got %v, want ErrInvalidDefinition", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got %v, want no error", err)
+			}
+		})
+	}
+}
+
+func TestDefinitionValidatePolicy(t *testing.T) {
+	d := &Definition{Steps: []StepDefinition{step("a")}}
+	if err := d.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if d.FailurePolicy != PolicyAbort {
+		t.Fatalf("policy %q, want %q by default", d.FailurePolicy, PolicyAbort)
+	}
+
+	d = &Definition{FailurePolicy: "retry", Steps: []StepDefinition{step("a")}}
+	if err := d.Validate(); !errors.Is(err, ErrInvalidDefinition) {
+		t.Fatalf("got %v, want ErrInvalidDefinition for an unknown policy", err)
+	}
+}
@@ -1,14 +1,27 @@
 package validators
 
 import (
+	"time"
+
 	v "github.com/serdarozerr/request-reply/pkg"
 )
 
+// jobs can't be scheduled further ahead than this
+const maxScheduleAhead = 365 * 24 * time.Hour
+
+// bcrypt ignores everything after the first 72 bytes
+const maxPasswordBytes = 72
+
 type CreateUser struct {
 	Name     string
 	Email    string
-	Password string
+	Password string `sensitive:"true"`
 	Age      int
+	// optional, when the user is created
+	RunAt *time.Time `json:"run_at"`
+	// optional, the user isn't created when the
+	// job hasn't run by then
+	ExpiresAt *time.Time `json:"expires_at"`
 }
 
 func (c CreateUser) Validate() map[string]string {
@@ -21,9 +34,22 @@ func (c CreateUser) Validate() map[string]string {
 	}
 	if v.ValidateEmptyField(c.Password) {
 		errors["Password"] = "Password cannot be empty"
+	} else if len(c.Password) > maxPasswordBytes {
+		errors["Password"] = "Password cannot be longer than 72 bytes"
 	}
 	if c.Age == 0 {
 		errors["Age"] = "Age cannot be zero"
 	}
+	if c.RunAt != nil && time.Until(*c.RunAt) > maxScheduleAhead {
+		errors["RunAt"] = "RunAt cannot be more than a year ahead"
+	}
+	if c.ExpiresAt != nil {
+		switch {
+		case !c.ExpiresAt.After(time.Now()):
+			errors["ExpiresAt"] = "ExpiresAt must be in the future"
+		case c.RunAt != nil && !c.ExpiresAt.After(*c.RunAt):
+			errors["ExpiresAt"] = "ExpiresAt must be after RunAt"
+		}
+	}
 	return errors
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"net/http"
 	"os"
@@ -12,10 +13,22 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/go-pg/pg/v10"
 	"github.com/serdarozerr/request-reply/internal/api"
 	"github.com/serdarozerr/request-reply/internal/config"
+	"github.com/serdarozerr/request-reply/internal/database"
+	"github.com/serdarozerr/request-reply/internal/service/blobstore"
+	"github.com/serdarozerr/request-reply/internal/service/encryption"
+	"github.com/serdarozerr/request-reply/internal/service/idempotency"
+	"github.com/serdarozerr/request-reply/internal/service/jobs"
+	"github.com/serdarozerr/request-reply/internal/service/inbox"
+	"github.com/serdarozerr/request-reply/internal/service/leader"
+	"github.com/serdarozerr/request-reply/internal/service/outbox"
+	"github.com/serdarozerr/request-reply/internal/service/quarantine"
 	"github.com/serdarozerr/request-reply/internal/service/queue"
 	"github.com/serdarozerr/request-reply/internal/service/queue/handlers"
+	"github.com/serdarozerr/request-reply/internal/service/scheduler"
+	"github.com/serdarozerr/request-reply/migrations"
 )
 
 func configureLogger() {
@@ -37,61 +50,196 @@ func getSqsClient(awsCfg *config.AWSConfig) *sqs.Client{
 	return client
 }
 func getQueueURL(ctx context.Context, client *sqs.Client, awsCfg *config.AWSConfig) string{
+	if awsCfg.QueueURL !=""{
+		return awsCfg.QueueURL
+	}
+	return getOrCreateQueue(ctx,client,awsCfg.Name)
+}
+
+func getOrCreateQueue(ctx context.Context, client *sqs.Client, name string) string{
 	queueMgr:=queue.NewQueuManager(client)
 
-	queueUrl:=awsCfg.QueueURL
-	var err error
-	if awsCfg.QueueURL ==""{
-		queueUrl,err=queueMgr.GetQueueUrl(ctx,awsCfg.Name)
+	queueUrl,err:=queueMgr.GetQueueUrl(ctx,name)
+	if err!=nil{
+		queueUrl,err=queueMgr.CrateStandartQueue(ctx,name, 30, 345600)
 		if err!=nil{
-			queueUrl,err=queueMgr.CrateStandartQueue(ctx,awsCfg.Name, 30, 345600)
-			if err!=nil{
-				slog.Error("Failed to create queue","error",err)
+			slog.Error("Failed to create queue","error",err)
+			panic(1)
+		}
+		slog.Info("Qeueu created","name",name)
+	}
+	return queueUrl
+}
+
+// copyRedrivePolicy gives a lane queue the dead letter queue of the
+// default one, so failing messages end up dead on every lane
+func copyRedrivePolicy(ctx context.Context, client *sqs.Client, from, to string){
+	queueMgr:=queue.NewQueuManager(client)
+
+	policy,err:=queueMgr.GetRedrivePolicy(ctx,from)
+	if err!=nil{
+		slog.Error("Failed to read redrive policy","error",err)
+		panic(1)
+	}
+	if policy==nil{
+		slog.Warn("Default queue has no dead letter queue, lane queues get none either","lane_queue",to)
+		return
+	}
+	if err:=queueMgr.ConfigureDeadLetterQueue(ctx,to,policy.DeadLetterTargetArn,policy.MaxReceiveCount); err!=nil{
+		slog.Error("Failed to configure lane dead letter queue","error",err)
+		panic(1)
+	}
+}
+
+// getMaxReceiveCount reads maxReceiveCount from the queue's redrive
+// policy, the config value is only used for queues without one
+func getMaxReceiveCount(ctx context.Context, client *sqs.Client, cfg *config.Config, queueURL string) int{
+	queueMgr:=queue.NewQueuManager(client)
+
+	policy,err:=queueMgr.GetRedrivePolicy(ctx,queueURL)
+	if err!=nil{
+		slog.Error("Failed to read redrive policy","error",err)
+		panic(1)
+	}
+	if policy==nil{
+		if cfg.MaxReceiveCount==0{
+			slog.Warn("Queue has no dead letter queue, retried jobs are never marked dead")
+		}
+		return cfg.MaxReceiveCount
+	}
+	if cfg.MaxReceiveCount!=0 && cfg.MaxReceiveCount!=policy.MaxReceiveCount{
+		slog.Warn("max_receive_count differs from the redrive policy, using the policy","config",cfg.MaxReceiveCount,"policy",policy.MaxReceiveCount)
+	}
+	return policy.MaxReceiveCount
+}
+
+// getLanes resolves the queues of the configured lanes and the
+// type routes, the default lane is added when it isn't listed
+func getLanes(ctx context.Context, client *sqs.Client, cfg *config.Config, defaultURL string) ([]queue.Lane, map[string]string){
+	if len(cfg.Lanes)==0{
+		return nil,nil
+	}
+
+	lanes:=[]queue.Lane{{Name: queue.DefaultLane, QueueURL: defaultURL, Weight: 1}}
+	types:=make(map[string]string)
+	for _,l:=range cfg.Lanes{
+		if l.Name==queue.DefaultLane{
+			lanes[0].Weight=l.Weight
+		}else{
+			if l.QueueName==""{
+				slog.Error("Lane has no queue name","lane",l.Name)
 				panic(1)
 			}
-			slog.Info("Qeueu created")
+			laneURL:=getOrCreateQueue(ctx,client,l.QueueName)
+			copyRedrivePolicy(ctx,client,defaultURL,laneURL)
+			lanes=append(lanes,queue.Lane{Name: l.Name, QueueURL: laneURL, Weight: l.Weight})
+		}
+		for _,t:=range l.Types{
+			types[t]=l.Name
 		}
 	}
-	return queueUrl
+	return lanes,types
 }
 
-func getProducerQueue(ctx context.Context,awsCfg *config.AWSConfig) *queue.Producer{
+func getProducerQueue(ctx context.Context, cfg *config.Config, awsCfg *config.AWSConfig) *queue.Producer{
 	client:=getSqsClient(awsCfg)
 	queueUrl:=getQueueURL(ctx,client,awsCfg)
 	awsCfg.QueueURL=queueUrl
 	prod:=queue.NewProducer(client,queueUrl)
+	if lanes,types:=getLanes(ctx,client,cfg,queueUrl); len(lanes)>0{
+		if err:=prod.WithLanes(lanes,types); err!=nil{
+			slog.Error("Invalid lanes","error",err)
+			panic(1)
+		}
+	}
 	return prod
 }
 
 
 
 
-func getConsumerQueue(ctx context.Context, awsCfg *config.AWSConfig) *queue.Consumer{
+func getDatabase(cfg *config.Config) *pg.DB{
+	db,err:=database.Connect(context.Background(),cfg.Database)
+	if err!=nil{
+		slog.Error("Failed to connect database","error",err)
+		panic(1)
+	}
+	return db
+}
+
+func getKeyProvider(cfg *config.Config) encryption.KeyProvider{
+	kp,err:=encryption.NewLocalKeyProvider(cfg.EncryptionKeyFile)
+	if err!=nil{
+		slog.Error("Failed to load encryption keys","error",err)
+		panic(1)
+	}
+	return kp
+}
+
+// returns nil when claim check is not configured
+func getBlobStore(cfg *config.Config) blobstore.BlobStore{
+	if cfg.ClaimCheck.Dir==""{
+		return nil
+	}
+	store,err:=blobstore.NewLocalStore(cfg.ClaimCheck.Dir)
+	if err!=nil{
+		slog.Error("Failed to create blob store","error",err)
+		panic(1)
+	}
+	return store
+}
+
+func getResultStore(cfg *config.Config, db *pg.DB) *jobs.ResultStore{
+	var store blobstore.BlobStore
+	if cfg.Results.Dir!=""{
+		var err error
+		store,err=blobstore.NewLocalStore(cfg.Results.Dir)
+		if err!=nil{
+			slog.Error("Failed to create result store","error",err)
+			panic(1)
+		}
+	}
+	return jobs.NewResultStore(db,store,cfg.Results.InlineMaxBytes,cfg.ResultRetention())
+}
+
+func getConsumerQueue(ctx context.Context, cfg *config.Config, awsCfg *config.AWSConfig, db *pg.DB, results *jobs.ResultStore, metrics *queue.Metrics) *queue.Consumer{
 	client:=getSqsClient(awsCfg)
 	queueUrl:=getQueueURL(ctx, client, awsCfg)
+	lanes,_:=getLanes(ctx,client,cfg,queueUrl)
 	cons:=queue.NewConsumer(client,
 	queue.ConsumerConfig{
 		QueueURL:          queueUrl,
+		Lanes:             lanes,
         MaxMessages:       10,
         VisibilityTimeout: 30,
         WaitTimeSeconds:   20,
         WorkerCount:       5,
+		Inbox:             inbox.NewPostgresStore(db),
+		BlobStore:         getBlobStore(cfg),
+		KeyProvider:       getKeyProvider(cfg),
+		Tracker:           jobs.NewTracker(db, getMaxReceiveCount(ctx, client, cfg, queueUrl), results),
+		Quarantine:        quarantine.NewPostgresStore(db),
 	},
-	handlers.MessageHandler)
+	handlers.New(db).Router(metrics,queue.LogSpanExporter{}))
 	return cons
 }
 
 // This mode start a server with endpoints that
 // time taking tasks/jobs will be passed to queue
 // to send worker server
-func startProducerServer(cfg *config.Config, awsCfg *config.AWSConfig){
+func startProducerServer(cfg *config.Config){
 	slog.Info("Starting server", "host", cfg.Host, "port",cfg.Port)
 
-	producer:=getProducerQueue(context.Background(),awsCfg)
+	db:=getDatabase(cfg)
+	defer db.Close()
+
+	purgeCtx,stopPurge:=context.WithCancel(context.Background())
+	defer stopPurge()
+	go purgeIdempotencyKeys(purgeCtx,idempotency.NewPostgresStore(db))
 
 	s := http.Server{
 		Addr:    fmt.Sprintf("%s:%s",cfg.Host,cfg.Port),
-		Handler: api.NewRouter(producer),
+		Handler: api.NewRouter(cfg,db,getKeyProvider(cfg),getResultStore(cfg,db)),
 		ReadTimeout: 10 *time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
@@ -124,9 +272,18 @@ func startProducerServer(cfg *config.Config, awsCfg *config.AWSConfig){
 // This mode is worker mode, listens the queue
 // and process any task/job, no endpoints exposes
 // in this mode
-func startConsumerWorker(awsCfg *config.AWSConfig){
+func startConsumerWorker(cfg *config.Config, awsCfg *config.AWSConfig){
 	ctx:=context.Background()
-	consumer:=getConsumerQueue(ctx,awsCfg)
+	db:=getDatabase(cfg)
+	defer db.Close()
+
+	handlers.RegisterCompensations()
+	results:=getResultStore(cfg,db)
+	metrics:=queue.NewMetrics()
+	consumer:=getConsumerQueue(ctx,cfg,awsCfg,db,results,metrics)
+	go purgeJobResults(ctx,results)
+	go logHandlerMetrics(ctx,metrics)
+	go jobs.ListenCancellations(ctx,db,consumer.Cancel)
 	go func ()  {
 		slog.Info("starting consumer")
 		if err:=consumer.Start(ctx); err != nil{
@@ -144,21 +301,263 @@ func startConsumerWorker(awsCfg *config.AWSConfig){
 
 }
 
+func purgeIdempotencyKeys(ctx context.Context, store *idempotency.PostgresStore){
+	ticker:=time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		if _,err:=store.Purge(ctx); err!=nil{
+			slog.Error("purging idempotency keys","error",err)
+		}
+		select{
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func logHandlerMetrics(ctx context.Context, metrics *queue.Metrics){
+	ticker:=time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select{
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for msgType,m:=range metrics.Snapshot(){
+			slog.Info("handler metrics","type",msgType,"handled",m.Handled,"failed",m.Failed,"duration",m.Duration,"max_duration",m.MaxDuration)
+		}
+	}
+}
+
+func purgeJobResults(ctx context.Context, results *jobs.ResultStore){
+	ticker:=time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		n,err:=results.Purge(ctx)
+		if err!=nil{
+			slog.Error("purging job results","error",err)
+		} else if n>0{
+			slog.Info("purged job results","deleted",n)
+		}
+		select{
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// This mode publishes the messages written to the
+// outbox table by the producer server to the queue
+func startOutboxRelay(cfg *config.Config, awsCfg *config.AWSConfig){
+	ctx,cancel:=context.WithCancel(context.Background())
+	defer cancel()
+
+	db:=getDatabase(cfg)
+	defer db.Close()
+
+	producer:=getProducerQueue(ctx,cfg,awsCfg)
+	if store:=getBlobStore(cfg); store!=nil{
+		producer.WithClaimCheck(store,cfg.ClaimCheck.ThresholdBytes)
+	}
+	relay:=outbox.NewRelay(db,producer,outbox.RelayConfig{OnFail: jobs.Fail})
+
+	// only one relay publishes at a time, the others take
+	// over when its lease expires
+	elector:=leader.New(db,leader.Config{
+		Name: "outbox-relay",
+		OnElected: func(ctx context.Context, lease *leader.Lease){
+			slog.Info("starting outbox relay","token",lease.Token)
+			if err:=relay.Start(ctx); err != nil && ctx.Err() == nil{
+				slog.Error("outbox relay stopped", "error",err)
+			}
+		},
+	})
+
+	done:=make(chan struct{})
+	go func ()  {
+		defer close(done)
+		elector.Run(ctx)
+	}()
+
+	quit :=make(chan os.Signal,1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	slog.Info("Shutting down outbox relay")
+	cancel()
+	<-done
+
+	closeCtx,closeCancel:=context.WithTimeout(context.Background(),10*time.Second)
+	defer closeCancel()
+	if err:=relay.Close(closeCtx); err!=nil{
+		slog.Error("flushing outbox relay","error",err)
+	}
+}
+
+// This mode moves jobs scheduled beyond the SQS delay limit
+// to the outbox when they are due and runs the cron jobs, any
+// number of instances can run, only the leader is active
+func startScheduler(cfg *config.Config){
+	ctx,cancel:=context.WithCancel(context.Background())
+	defer cancel()
+
+	db:=getDatabase(cfg)
+	defer db.Close()
+
+	sched:=scheduler.New(db,scheduler.Config{})
+	elector:=leader.New(db,leader.Config{
+		Name: "scheduler",
+		OnElected: func(ctx context.Context, lease *leader.Lease){
+			slog.Info("starting scheduler","token",lease.Token)
+			if err:=sched.Run(ctx); err != nil && ctx.Err() == nil{
+				slog.Error("scheduler stopped", "error",err)
+			}
+		},
+	})
+
+	done:=make(chan struct{})
+	go func ()  {
+		defer close(done)
+		elector.Run(ctx)
+	}()
+
+	quit :=make(chan os.Signal,1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	slog.Info("Shutting down scheduler")
+	cancel()
+	<-done
+}
+
+// migrate up|down|status|baseline <version>|create <name>, migrations are read from
+// dir, or from the copies embedded in the binary when dir is empty
+func runMigrate(cfg *config.Config, dir string, args []string){
+	if len(args)==0{
+		slog.Info("Usage: migrate up|down|status|baseline <version>|create <name>")
+		os.Exit(2)
+	}
+
+	if args[0]=="create"{
+		if len(args)<2{
+			slog.Info("Usage: migrate create <name>")
+			os.Exit(2)
+		}
+		if dir==""{
+			dir="migrations"
+		}
+		path,err:=database.CreateMigration(dir,args[1])
+		if err!=nil{
+			slog.Error("Failed to create migration","error",err)
+			os.Exit(1)
+		}
+		slog.Info("Created migration","path",path)
+		return
+	}
+
+	var fsys fs.FS=migrations.FS
+	if dir!=""{
+		fsys=os.DirFS(dir)
+	}
+	loaded,err:=database.LoadMigrations(fsys)
+	if err!=nil{
+		slog.Error("Failed to load migrations","error",err)
+		os.Exit(1)
+	}
+
+	ctx:=context.Background()
+	db:=getDatabase(cfg)
+	defer db.Close()
+	migrator:=database.NewMigrator(db,loaded)
+
+	switch args[0]{
+	case "up":
+		applied,err:=migrator.Up(ctx)
+		for _,m:=range applied{
+			slog.Info("Applied migration","version",m.Version,"name",m.Name)
+		}
+		if err!=nil{
+			slog.Error("Failed to apply migrations","error",err)
+			os.Exit(1)
+		}
+		slog.Info("Migrations are up to date","applied",len(applied))
+	case "down":
+		reverted,err:=migrator.Down(ctx)
+		if err!=nil{
+			slog.Error("Failed to revert migration","error",err)
+			os.Exit(1)
+		}
+		if reverted==nil{
+			slog.Info("No migration to revert")
+			return
+		}
+		slog.Info("Reverted migration","version",reverted.Version,"name",reverted.Name)
+	case "baseline":
+		// marks the migrations a hand made schema already
+		// has, the ones after version are applied by up
+		if len(args)<2{
+			slog.Info("Usage: migrate baseline <version>")
+			os.Exit(2)
+		}
+		marked,err:=migrator.Baseline(ctx,args[1])
+		if err!=nil{
+			slog.Error("Failed to baseline migrations","error",err)
+			os.Exit(1)
+		}
+		for _,m:=range marked{
+			slog.Info("Marked migration applied","version",m.Version,"name",m.Name)
+		}
+	case "status":
+		statuses,err:=migrator.Status(ctx)
+		if err!=nil{
+			slog.Error("Failed to read migration status","error",err)
+			os.Exit(1)
+		}
+		for _,s:=range statuses{
+			slog.Info("Migration","version",s.Version,"name",s.Name,"applied",s.Applied(),"applied_at",s.AppliedAt)
+		}
+	default:
+		slog.Info("Unsupported migrate command, supported commands are: up, down, status, baseline, create")
+		os.Exit(2)
+	}
+}
+
 func main() {
 	configPath:=flag.String("c","","configuration path")
 	queueConfigPath:=flag.String("qc","","configuration path s3 queue")
+	migrationsDir:=flag.String("migrations","","migrations directory, embedded migrations are used when empty")
+	flag.Parse()
 
 	configureLogger()
+
+	if flag.Arg(0)=="migrate"{
+		if flag.Arg(1)=="create"{
+			runMigrate(nil,*migrationsDir,flag.Args()[1:])
+			return
+		}
+		runMigrate(config.NewConfig(*configPath),*migrationsDir,flag.Args()[1:])
+		return
+	}
+
 	cfg:=config.NewConfig(*configPath)
-	awsCfg:=config.NewAwsConfig(*queueConfigPath)
 
 	switch cfg.Mode {
 	case "producer":
-		startProducerServer(cfg,awsCfg)
+		startProducerServer(cfg)
 	case "consumer":
-		startConsumerWorker(awsCfg)
+		startConsumerWorker(cfg,config.NewAwsConfig(*queueConfigPath))
+	case "relay":
+		startOutboxRelay(cfg,config.NewAwsConfig(*queueConfigPath))
+	case "scheduler":
+		startScheduler(cfg)
 	default:
-		slog.Info("Unsupported mode, supported modes are: producer, consumer")
+		slog.Info("Unsupported mode, supported modes are: producer, consumer, relay, scheduler")
 		panic(1)	
 	}
 	
@@ -1,7 +1,11 @@
+-- +migrate up
 CREATE TABLE IF NOT EXISTS users(
     id SERIAL PRIMARY KEY,
     name VARCHAR(255) NOT NULL,
     email VARCHAR(255) NOT NULL UNIQUE,
     age INTEGER NOT NULL,
     password VARCHAR(255) NOT NULL
-);
\ No newline at end of file
+);
+
+-- +migrate down
+DROP TABLE IF EXISTS users;
@@ -1,3 +1,4 @@
+-- +migrate up
 CREATE TABLE IF NOT EXISTS jobs(
     id SERIAL PRIMARY KEY,
     job_id VARCHAR(36) NOT NULL UNIQUE,
@@ -5,4 +6,7 @@ CREATE TABLE IF NOT EXISTS jobs(
     created_at DATE DEFAULT CURRENT_DATE
 );
 
-CREATE INDEX idx_jobs_job_id ON jobs(job_id);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_jobs_job_id ON jobs(job_id);
+
+-- +migrate down
+DROP TABLE IF EXISTS jobs;
@@ -0,0 +1,10 @@
+-- +migrate up
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS type VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS parent_id VARCHAR(36);
+
+CREATE INDEX IF NOT EXISTS idx_jobs_parent_id ON jobs(parent_id);
+
+-- +migrate down
+DROP INDEX IF EXISTS idx_jobs_parent_id;
+ALTER TABLE jobs DROP COLUMN IF EXISTS parent_id;
+ALTER TABLE jobs DROP COLUMN IF EXISTS type;
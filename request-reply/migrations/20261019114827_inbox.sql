@@ -0,0 +1,15 @@
+-- +migrate up
+CREATE TABLE IF NOT EXISTS inbox(
+    message_id VARCHAR(255) PRIMARY KEY,
+    status VARCHAR(32) NOT NULL,
+    owner VARCHAR(255) NOT NULL,
+    lease_until TIMESTAMPTZ,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    completed_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_inbox_completed_at ON inbox(completed_at) WHERE status = 'completed';
+
+-- +migrate down
+DROP TABLE IF EXISTS inbox;
@@ -0,0 +1,5 @@
+-- +migrate up
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS last_error TEXT;
+
+-- +migrate down
+ALTER TABLE jobs DROP COLUMN IF EXISTS last_error;
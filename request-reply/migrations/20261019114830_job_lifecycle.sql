@@ -0,0 +1,38 @@
+-- +migrate up
+ALTER TABLE jobs ALTER COLUMN created_at TYPE TIMESTAMPTZ USING created_at::timestamptz;
+ALTER TABLE jobs ALTER COLUMN created_at SET DEFAULT now();
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS worker_id VARCHAR(255);
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS queued_at TIMESTAMPTZ;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS received_at TIMESTAMPTZ;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS started_at TIMESTAMPTZ;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS finished_at TIMESTAMPTZ;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS cancelled_at TIMESTAMPTZ;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;
+
+CREATE TABLE IF NOT EXISTS job_attempts(
+    id BIGSERIAL PRIMARY KEY,
+    job_id VARCHAR(36) NOT NULL REFERENCES jobs(job_id) ON DELETE CASCADE,
+    attempt INTEGER NOT NULL,
+    worker_id VARCHAR(255) NOT NULL,
+    status VARCHAR(32) NOT NULL,
+    error TEXT,
+    started_at TIMESTAMPTZ NOT NULL,
+    finished_at TIMESTAMPTZ,
+    duration_ms BIGINT
+);
+
+CREATE INDEX IF NOT EXISTS idx_job_attempts_job_id ON job_attempts(job_id);
+
+-- +migrate down
+DROP TABLE IF EXISTS job_attempts;
+ALTER TABLE jobs DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE jobs DROP COLUMN IF EXISTS cancelled_at;
+ALTER TABLE jobs DROP COLUMN IF EXISTS finished_at;
+ALTER TABLE jobs DROP COLUMN IF EXISTS started_at;
+ALTER TABLE jobs DROP COLUMN IF EXISTS received_at;
+ALTER TABLE jobs DROP COLUMN IF EXISTS queued_at;
+ALTER TABLE jobs DROP COLUMN IF EXISTS worker_id;
+ALTER TABLE jobs DROP COLUMN IF EXISTS attempts;
+ALTER TABLE jobs ALTER COLUMN created_at SET DEFAULT CURRENT_DATE;
+ALTER TABLE jobs ALTER COLUMN created_at TYPE DATE USING created_at::date;
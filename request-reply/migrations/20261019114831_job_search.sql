@@ -0,0 +1,14 @@
+-- +migrate up
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS submitter VARCHAR(255);
+
+CREATE INDEX IF NOT EXISTS idx_jobs_created_at ON jobs(created_at, id);
+CREATE INDEX IF NOT EXISTS idx_jobs_status_created_at ON jobs(status, created_at, id);
+CREATE INDEX IF NOT EXISTS idx_jobs_type_created_at ON jobs(type, created_at, id);
+CREATE INDEX IF NOT EXISTS idx_jobs_submitter_created_at ON jobs(submitter, created_at, id);
+
+-- +migrate down
+DROP INDEX IF EXISTS idx_jobs_submitter_created_at;
+DROP INDEX IF EXISTS idx_jobs_type_created_at;
+DROP INDEX IF EXISTS idx_jobs_status_created_at;
+DROP INDEX IF EXISTS idx_jobs_created_at;
+ALTER TABLE jobs DROP COLUMN IF EXISTS submitter;
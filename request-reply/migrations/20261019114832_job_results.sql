@@ -0,0 +1,17 @@
+-- +migrate up
+CREATE TABLE IF NOT EXISTS job_results(
+    job_id VARCHAR(36) PRIMARY KEY REFERENCES jobs(job_id) ON DELETE CASCADE,
+    content_type VARCHAR(255) NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    -- served back byte for byte, jsonb would reorder keys
+    inline BYTEA,
+    blob_ref VARCHAR(255),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    purged_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_job_results_expires_at ON job_results(expires_at);
+
+-- +migrate down
+DROP TABLE IF EXISTS job_results;
@@ -0,0 +1,16 @@
+-- +migrate up
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS run_at TIMESTAMPTZ;
+
+CREATE TABLE IF NOT EXISTS scheduled_jobs(
+    id BIGSERIAL PRIMARY KEY,
+    job_id VARCHAR(36) NOT NULL UNIQUE REFERENCES jobs(job_id) ON DELETE CASCADE,
+    message JSONB NOT NULL,
+    run_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_scheduled_jobs_run_at ON scheduled_jobs(run_at);
+
+-- +migrate down
+DROP TABLE IF EXISTS scheduled_jobs;
+ALTER TABLE jobs DROP COLUMN IF EXISTS run_at;
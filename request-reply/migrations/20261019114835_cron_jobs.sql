@@ -0,0 +1,19 @@
+-- +migrate up
+CREATE TABLE IF NOT EXISTS cron_jobs(
+    name VARCHAR(255) PRIMARY KEY,
+    type VARCHAR(255) NOT NULL,
+    schedule VARCHAR(255) NOT NULL,
+    timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    payload JSONB,
+    paused BOOLEAN NOT NULL DEFAULT false,
+    last_run_at TIMESTAMPTZ,
+    last_job_id VARCHAR(36),
+    next_run_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_cron_jobs_next_run_at ON cron_jobs(next_run_at) WHERE NOT paused;
+
+-- +migrate down
+DROP TABLE IF EXISTS cron_jobs;
@@ -0,0 +1,12 @@
+-- +migrate up
+CREATE TABLE IF NOT EXISTS leader_leases(
+    name VARCHAR(255) PRIMARY KEY,
+    holder VARCHAR(255) NOT NULL,
+    token BIGINT NOT NULL,
+    acquired_at TIMESTAMPTZ NOT NULL,
+    renewed_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- +migrate down
+DROP TABLE IF EXISTS leader_leases;
@@ -0,0 +1,32 @@
+-- +migrate up
+CREATE TABLE IF NOT EXISTS workflows(
+    workflow_id VARCHAR(36) PRIMARY KEY REFERENCES jobs(job_id) ON DELETE CASCADE,
+    failure_policy VARCHAR(32) NOT NULL,
+    status VARCHAR(32) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS workflow_steps(
+    id BIGSERIAL PRIMARY KEY,
+    workflow_id VARCHAR(36) NOT NULL REFERENCES workflows(workflow_id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    kind VARCHAR(32) NOT NULL,
+    type VARCHAR(255) NOT NULL,
+    depends_on JSONB NOT NULL DEFAULT '[]',
+    message JSONB NOT NULL,
+    job_id VARCHAR(36) NOT NULL UNIQUE,
+    status VARCHAR(32) NOT NULL,
+    result JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    enqueued_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ,
+    UNIQUE (workflow_id, name, kind)
+);
+
+CREATE INDEX IF NOT EXISTS idx_workflow_steps_workflow_id ON workflow_steps(workflow_id);
+
+-- +migrate down
+DROP TABLE IF EXISTS workflow_steps;
+DROP TABLE IF EXISTS workflows;
@@ -0,0 +1,16 @@
+-- +migrate up
+CREATE TABLE IF NOT EXISTS batches(
+    batch_id VARCHAR(36) PRIMARY KEY REFERENCES jobs(job_id) ON DELETE CASCADE,
+    total INTEGER NOT NULL DEFAULT 0,
+    succeeded INTEGER NOT NULL DEFAULT 0,
+    failed INTEGER NOT NULL DEFAULT 0,
+    cancelled INTEGER NOT NULL DEFAULT 0,
+    sealed BOOLEAN NOT NULL DEFAULT false,
+    on_complete JSONB,
+    callback_url TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    completed_at TIMESTAMPTZ
+);
+
+-- +migrate down
+DROP TABLE IF EXISTS batches;
@@ -0,0 +1,15 @@
+-- +migrate up
+CREATE TABLE IF NOT EXISTS quarantined_messages(
+    id BIGSERIAL PRIMARY KEY,
+    message_id VARCHAR(128) NOT NULL,
+    queue_url TEXT NOT NULL,
+    body TEXT NOT NULL,
+    error TEXT NOT NULL,
+    attributes JSONB,
+    quarantined_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_quarantined_messages_message_id ON quarantined_messages(message_id);
+
+-- +migrate down
+DROP TABLE IF EXISTS quarantined_messages;
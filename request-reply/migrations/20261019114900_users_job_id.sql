@@ -0,0 +1,7 @@
+-- +migrate up
+-- the job that created the user, a redelivered job
+-- finds its own user instead of a taken email
+ALTER TABLE users ADD COLUMN IF NOT EXISTS job_id VARCHAR(36);
+
+-- +migrate down
+ALTER TABLE users DROP COLUMN IF EXISTS job_id;
@@ -3,10 +3,9 @@ package middleware
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"strings"
-
-	"github.com/serdarozerr/request-reply/internal/config"
 )
 
 type Middleware func(http.Handler) http.Handler
@@ -24,7 +23,24 @@ func extractBearerToken(r *http.Request) (string, error) {
 	return parts[1], nil
 }
 
-func AuthMiddleware(c *config.Config) Middleware {
+// Identity is the caller resolved from a verified token, Subject
+// is what jobs record as their submitter
+type Identity struct {
+	Subject string
+}
+
+// TokenVerifier checks an access token and resolves its identity
+type TokenVerifier interface {
+	Verify(ctx context.Context, token string) (*Identity, error)
+}
+
+type identityKey struct{}
+
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+func AuthMiddleware(v TokenVerifier) Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			accessToken, err := extractBearerToken(r)
@@ -33,10 +49,26 @@ func AuthMiddleware(c *config.Config) Middleware {
 				return
 			}
 
-			// In a real application, you would verify the access token here (e.g., by checking it against a database or an external authentication service).
-			ctx := context.WithValue(r.Context(), "user", accessToken)
+			// only the resolved identity is kept, the
+			// token itself never reaches the handlers
+			id, err := v.Verify(r.Context(), accessToken)
+			if err != nil {
+				slog.Info("rejected access token", "error", err)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
 
-			next.ServeHTTP(w, r.WithContext(ctx))
+			next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), id)))
 		})
 	}
 }
+
+// UserFromContext returns the subject set by AuthMiddleware,
+// empty when the request wasn't authenticated
+func UserFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	if id == nil {
+		return ""
+	}
+	return id.Subject
+}
@@ -0,0 +1,169 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// bodies of requests sent with a key are read in memory
+	// to fingerprint them, larger ones are rejected
+	maxIdempotentBodyBytes = 1 << 20
+)
+
+// IdempotencyRecord is the stored outcome of a request
+type IdempotencyRecord struct {
+	Fingerprint string
+	Completed   bool
+	StatusCode  int
+	Header      http.Header
+	Body        []byte
+}
+
+// IdempotencyStore keeps keys per owner, the subject of the caller,
+// so clients picking the same key never see each other's responses
+type IdempotencyStore interface {
+	// Reserve stores the key for an in progress request locked for
+	// lock, when the key is already stored and not expired it returns
+	// the stored record. An in progress key whose lock ran out is
+	// taken over by a request with the same fingerprint
+	Reserve(ctx context.Context, owner, key, fingerprint string, lock, ttl time.Duration) (*IdempotencyRecord, error)
+	// Save stores the response of the request holding the key
+	Save(ctx context.Context, owner, key string, rec *IdempotencyRecord) error
+	// Delete drops the key so the request can be retried
+	Delete(ctx context.Context, owner, key string) error
+}
+
+// Idempotency replays the stored response when a caller repeats a
+// request with the same Idempotency-Key, reusing a key with a
+// different request is rejected with 422. lock should be a little
+// over the request timeout, a request that crashed holds its key
+// that long. Keys are scoped to UserFromContext, run it behind
+// AuthMiddleware
+func Idempotency(store IdempotencyStore, lock, ttl time.Duration) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(IdempotencyKeyHeader)
+			if key == "" {
+				next(w, r)
+				return
+			}
+			if len(key) > 255 {
+				http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodyBytes))
+			if err != nil {
+				http.Error(w, "request body is too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body.Close()
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			fingerprint := requestFingerprint(r, body)
+			owner := UserFromContext(r.Context())
+
+			existing, err := store.Reserve(r.Context(), owner, key, fingerprint, lock, ttl)
+			if err != nil {
+				slog.Error("reserving idempotency key", "error", err)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			if existing != nil {
+				switch {
+				case existing.Fingerprint != fingerprint:
+					http.Error(w, "Idempotency-Key was used with a different request", http.StatusUnprocessableEntity)
+				case !existing.Completed:
+					http.Error(w, "a request with this Idempotency-Key is in progress", http.StatusConflict)
+				default:
+					replay(w, existing)
+				}
+				return
+			}
+
+			ctx := context.WithoutCancel(r.Context())
+
+			// a panicking handler gives the key up right away
+			defer func() {
+				if p := recover(); p != nil {
+					if err := store.Delete(ctx, owner, key); err != nil {
+						slog.Error("deleting idempotency key", "error", err)
+					}
+					panic(p)
+				}
+			}()
+
+			rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			next(rec, r)
+
+			// server errors are not stored, the client may retry them
+			if rec.status >= http.StatusInternalServerError {
+				if err := store.Delete(ctx, owner, key); err != nil {
+					slog.Error("deleting idempotency key", "error", err)
+				}
+				return
+			}
+
+			err = store.Save(ctx, owner, key, &IdempotencyRecord{
+				Fingerprint: fingerprint,
+				Completed:   true,
+				StatusCode:  rec.status,
+				Header:      w.Header().Clone(),
+				Body:        rec.body.Bytes(),
+			})
+			if err != nil {
+				slog.Error("saving idempotent response", "error", err)
+			}
+		}
+	}
+}
+
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method))
+	h.Write([]byte{0})
+	h.Write([]byte(r.URL.Path))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func replay(w http.ResponseWriter, rec *IdempotencyRecord) {
+	for k, v := range rec.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(rec.StatusCode)
+	w.Write(rec.Body)
+}
+
+// responseRecorder writes through and keeps a copy of the response
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
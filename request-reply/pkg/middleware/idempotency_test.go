@@ -0,0 +1,145 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryIdempotencyStore keeps keys in a map, locks and ttls are ignored
+type memoryIdempotencyStore struct {
+	mu   sync.Mutex
+	recs map[string]*IdempotencyRecord
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{recs: make(map[string]*IdempotencyRecord)}
+}
+
+func (s *memoryIdempotencyStore) Reserve(ctx context.Context, owner, key, fingerprint string, lock, ttl time.Duration) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, ok := s.recs[owner+"/"+key]; ok {
+		return rec, nil
+	}
+	s.recs[owner+"/"+key] = &IdempotencyRecord{Fingerprint: fingerprint}
+	return nil, nil
+}
+
+func (s *memoryIdempotencyStore) Save(ctx context.Context, owner, key string, rec *IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec.Fingerprint = s.recs[owner+"/"+key].Fingerprint
+	s.recs[owner+"/"+key] = rec
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Delete(ctx context.Context, owner, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.recs, owner+"/"+key)
+	return nil
+}
+
+// countingHandler answers with the number of times it ran
+func countingHandler(status int) (http.HandlerFunc, *int) {
+	calls := 0
+	return func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "call %d", calls)
+	}, &calls
+}
+
+func idempotentRequest(h http.HandlerFunc, subject, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/user", strings.NewReader(body))
+	r.Header.Set(IdempotencyKeyHeader, key)
+	if subject != "" {
+		r = r.WithContext(WithIdentity(r.Context(), &Identity{Subject: subject}))
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestIdempotencyReplaysForTheSameCaller(t *testing.T) {
+	next, calls := countingHandler(http.StatusAccepted)
+	h := Idempotency(newMemoryIdempotencyStore(), time.Second, time.Hour)(next)
+
+	first := idempotentRequest(h, "alice", "k1", `{"a":1}`)
+	second := idempotentRequest(h, "alice", "k1", `{"a":1}`)
+
+	if *calls != 1 {
+		t.Fatalf("handler ran %d times, want 1", *calls)
+	}
+	if second.Code != http.StatusAccepted || second.Body.String() != first.Body.String() {
+		t.Fatalf("replay %d %q, want %d %q", second.Code, second.Body, first.Code, first.Body)
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatal("replayed response is not marked")
+	}
+}
+
+func TestIdempotencyKeysAreScopedToTheCaller(t *testing.T) {
+	next, calls := countingHandler(http.StatusAccepted)
+	h := Idempotency(newMemoryIdempotencyStore(), time.Second, time.Hour)(next)
+
+	idempotentRequest(h, "alice", "k1", `{"a":1}`)
+	bob := idempotentRequest(h, "bob", "k1", `{"b":2}`)
+
+	if *calls != 2 {
+		t.Fatalf("handler ran %d times, want once per caller", *calls)
+	}
+	if bob.Code != http.StatusAccepted || bob.Body.String() != "call 2" {
+		t.Fatalf("bob got %d %q, want his own response", bob.Code, bob.Body)
+	}
+}
+
+func TestIdempotencyRejectsReuseWithAnotherBody(t *testing.T) {
+	next, _ := countingHandler(http.StatusAccepted)
+	h := Idempotency(newMemoryIdempotencyStore(), time.Second, time.Hour)(next)
+
+	idempotentRequest(h, "alice", "k1", `{"a":1}`)
+	w := idempotentRequest(h, "alice", "k1", `{"a":2}`)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got %d, want 422", w.Code)
+	}
+}
+
+func TestIdempotencyReleasesKeyOnServerError(t *testing.T) {
+	next, calls := countingHandler(http.StatusInternalServerError)
+	h := Idempotency(newMemoryIdempotencyStore(), time.Second, time.Hour)(next)
+
+	idempotentRequest(h, "alice", "k1", `{"a":1}`)
+	idempotentRequest(h, "alice", "k1", `{"a":1}`)
+
+	if *calls != 2 {
+		t.Fatalf("handler ran %d times, want the retry to run again", *calls)
+	}
+}
+
+func TestIdempotencyReleasesKeyOnPanic(t *testing.T) {
+	store := newMemoryIdempotencyStore()
+	h := Idempotency(store, time.Second, time.Hour)(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("panic was swallowed")
+			}
+		}()
+		idempotentRequest(h, "alice", "k1", `{"a":1}`)
+	}()
+
+	if len(store.recs) != 0 {
+		t.Fatalf("key kept after a panic: %v", store.recs)
+	}
+}
@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/serdarozerr/request-reply/internal/config"
+)
+
+var ErrInvalidToken = errors.New("invalid access token")
+
+// JWTVerifier accepts HS256 signed JWTs, the sub claim
+// becomes the identity
+type JWTVerifier struct {
+	secret []byte
+	issuer string
+	now    func() time.Time
+}
+
+// NewJWTVerifier loads the shared secret from cfg.JWTSecretFile
+func NewJWTVerifier(cfg config.AuthConfig) (*JWTVerifier, error) {
+	secret, err := os.ReadFile(cfg.JWTSecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading jwt secret: %w", err)
+	}
+	secret = []byte(strings.TrimSpace(string(secret)))
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("jwt secret must be at least 32 bytes")
+	}
+	return &JWTVerifier{secret: secret, issuer: cfg.Issuer, now: time.Now}, nil
+}
+
+type jwtClaims struct {
+	Subject   string `json:"sub"`
+	Issuer    string `json:"iss"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf"`
+}
+
+func (v *JWTVerifier) Verify(ctx context.Context, token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return nil, fmt.Errorf("%w: unsupported header", ErrInvalidToken)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+	}
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed claims", ErrInvalidToken)
+	}
+
+	now := v.now().Unix()
+	switch {
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	case claims.ExpiresAt == 0 || now >= claims.ExpiresAt:
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	case claims.NotBefore != 0 && now < claims.NotBefore:
+		return nil, fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	case v.issuer != "" && claims.Issuer != v.issuer:
+		return nil, fmt.Errorf("%w: wrong issuer", ErrInvalidToken)
+	}
+	return &Identity{Subject: claims.Subject}, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}